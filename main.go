@@ -3,21 +3,34 @@ package main
 import (
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/dkoshkin/kube-external-dns/pkg/audit"
+	"github.com/dkoshkin/kube-external-dns/pkg/config"
 	dnscontroller "github.com/dkoshkin/kube-external-dns/pkg/controller"
+	"github.com/dkoshkin/kube-external-dns/pkg/credentials"
+	"github.com/dkoshkin/kube-external-dns/pkg/notify"
 	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
 	"github.com/dkoshkin/kube-external-dns/pkg/server"
 	"github.com/dkoshkin/kube-external-dns/pkg/tpr"
 	dnstpr "github.com/dkoshkin/kube-external-dns/pkg/tpr/domainname"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	// Only required to authenticate against GKE clusters
@@ -34,19 +47,76 @@ var version string
 var buildDate string
 
 func main() {
+	// read the configuration file and environment overrides
+	cfg, err := config.Load()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	// cancelled on shutdown, stops the informers and in-flight provider calls
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopCh := ctx.Done()
+	for _, p := range cfg.Providers {
+		// providers with a secret are configured once the secret is loaded
+		if p.SecretRef != nil {
+			continue
+		}
+		if err := credentials.Configure(ctx, p, dnsprovider.Options(p.Options)); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	dnsprovider.ZoneCacheTTL = cfg.Controller.ZoneCacheTTL.Duration
+	dnscontroller.Configure(cfg)
+
+	router := server.NewRouter(version, buildDate)
+	// log every change made to the providers
+	if cfg.Audit.Output != "" {
+		auditLog, err := audit.Open(cfg.Audit.Output)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer auditLog.Close()
+		dnscontroller.SetAuditLog(auditLog)
+		router.Handle("/audit", server.AuditHandler(auditLog))
+	}
+	// post record changes and sync failures to webhooks
+	if webhooks := cfg.Notifications.Webhooks; len(webhooks) > 0 {
+		notifier, err := notify.New(webhooks)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer notifier.Close()
+		dnscontroller.SetNotifier(notifier)
+		// without resync a failed service is only synced again on its next event
+		if cfg.Controller.ResyncPeriod.Duration <= 0 && cfg.Notifications.FailureThreshold > 1 {
+			logrus.Warnf("notifications.failureThreshold is %d but controller.resyncPeriod is not set, failed syncs are only retried on service events", cfg.Notifications.FailureThreshold)
+		}
+	}
+
 	// creates a kubeconfig
-	config, err := buildKubecConfig()
+	kubeConfig, err := buildKubecConfig()
 	if err != nil {
 		panic(err.Error())
 	}
 	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
 	if err != nil {
 		panic(err.Error())
 	}
 
+	// record events about services, e.g. an invalid host name
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: clientset.Core().Events("")})
+	dnscontroller.SetEventRecorder(broadcaster.NewRecorder(api.Scheme, v1.EventSource{Component: "kube-external-dns"}))
+
+	// load and watch provider credentials stored in secrets
+	if err := credentials.NewWatcher(clientset, cfg.Providers, cfg.Controller.OperationTimeout.Duration).Run(ctx); err != nil {
+		logrus.Fatal(err)
+	}
+
 	// get k8s client with TPRs based on default config
-	tprClient := tpr.GetClient(config, &dnstpr.DomainName{}, &dnstpr.DomainNameList{})
+	tprClient := tpr.GetClient(kubeConfig, &dnstpr.DomainName{}, &dnstpr.DomainNameList{})
 	// initialize the TPR with the API server
 	domainNameTPR := dnstpr.New(tprClient)
 	err = tpr.Initialize(clientset, domainNameTPR)
@@ -60,7 +130,11 @@ func main() {
 		v1.NamespaceAll,
 		fields.Everything())
 
-	_, controller := cache.NewInformer(
+	// services are only published once all of them are known, otherwise a
+	// name could be published for a service and withdrawn once the service
+	// created before it is listed
+	var synced int32
+	store, controller := cache.NewInformer(
 		watchlist,
 		&v1.Service{},
 		time.Second*0,
@@ -68,82 +142,278 @@ func main() {
 			AddFunc: func(obj interface{}) {
 				service := obj.(*v1.Service)
 				logrus.Infof("%s: service add event", service.Name)
-				changed, providerRecord, err := dnscontroller.UpsertToDNSProvider(service)
-				if err != nil {
-					logrus.Error(err)
-				}
-				if changed {
-					logrus.Infof("%s: provider DNS record changed succesfully", service.Name)
-					// Update DomainName TPR
-					if err != createOrUpdateDomainNameTPR(service, providerRecord, domainNameTPR) {
-						logrus.Errorf("%s: DomainName TPR could not updated: %v", service.Name, err)
-					}
-					logrus.Infof("%s: DomainName TPR changed succesfully", service.Name)
+				dnscontroller.IndexService(ctx, service)
+				if atomic.LoadInt32(&synced) == 1 {
+					upsertService(ctx, service, domainNameTPR)
 				}
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
 				service := newObj.(*v1.Service)
 				logrus.Infof("%s: service update event", service.Name)
-				changed, providerRecord, err := dnscontroller.UpsertToDNSProvider(service)
-				if err != nil {
-					logrus.Error(err)
-				}
-				if changed {
-					logrus.Infof("%s: provider DNS record changed succesfully", service.Name)
-					// Update DomainName TPR
-					if err != createOrUpdateDomainNameTPR(service, providerRecord, domainNameTPR) {
-						logrus.Errorf("%s: DomainName TPR could not updated: %v", service.Name, err)
+				claimants := dnscontroller.Claimants(ctx, oldObj.(*v1.Service))
+				dnscontroller.IndexService(ctx, service)
+				if atomic.LoadInt32(&synced) == 1 {
+					upsertService(ctx, service, domainNameTPR)
+					// the services waiting for a name the service no longer
+					// claims take it over
+					for _, claimant := range released(claimants, dnscontroller.Claimants(ctx, service)) {
+						logrus.Infof("%s: service also claims a name released by service %s", claimant.Name, service.Name)
+						upsertService(ctx, claimant, domainNameTPR)
 					}
-					logrus.Infof("%s: DomainName TPR changed succesfully", service.Name)
 				}
 			},
 			DeleteFunc: func(obj interface{}) {
 				service := obj.(*v1.Service)
 				logrus.Infof("%s: service delete event", service.Name)
-				changed, _, err := dnscontroller.DeleteToDNSProvider(service)
+				results, err := dnscontroller.DeleteToDNSProvider(ctx, service)
 				if err != nil {
 					logrus.Error(err)
+					return
+				}
+				failed := false
+				for _, result := range results {
+					if result.Err != nil {
+						logrus.Error(result.Err)
+						failed = true
+					} else if result.Changed {
+						logrus.Infof("%s: provider %s DNS record deleted succesfully", service.Name, result.Provider)
+					}
+				}
+				// keep the failures visible until the records are removed by hand
+				if failed {
+					if err := updateDomainName(service, results, domainNameTPR); err != nil {
+						logrus.Errorf("%s: DomainName TPR could not updated: %v", service.Name, err)
+					}
+					return
 				}
-				if changed {
-					logrus.Infof("%s: provider DNS record deleted succesfully", service.Name)
-					// Delete TPR
-					err := domainNameTPR.Delete(service.Name, service.Namespace)
-					if err != nil {
+				if len(results) > 0 {
+					if err := domainNameTPR.Delete(service.Name, service.Namespace); err != nil {
 						logrus.Errorf("%s: DomainName TPR could not deleted: %v", service.Name, err)
+						return
 					}
 					logrus.Infof("%s: DomainName TPR deleted succesfully", service.Name)
 				}
+				// the next service claiming the name takes it over
+				claimants := dnscontroller.Claimants(ctx, service)
+				dnscontroller.UnindexService(service)
+				for _, claimant := range claimants {
+					logrus.Infof("%s: service also claims the name of deleted service %s", claimant.Name, service.Name)
+					upsertService(ctx, claimant, domainNameTPR)
+				}
 			},
 		},
 	)
 
-	go controller.Run(wait.NeverStop)
+	go controller.Run(stopCh)
+
+	// reject services with invalid annotations before they are created
+	var admissionSrv *http.Server
+	if address := cfg.Admission.Address; address != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/validate", server.AdmissionHandler(func(service *v1.Service) error {
+			ctx, cancel := context.WithTimeout(ctx, cfg.Controller.OperationTimeout.Duration)
+			defer cancel()
+			return dnscontroller.ValidateService(ctx, service)
+		}))
+		admissionSrv = &http.Server{Addr: address, Handler: mux}
+		go func() {
+			// conflicts can only be found once the services are listed
+			if !cache.WaitForCacheSync(stopCh, controller.HasSynced) {
+				return
+			}
+			logrus.Infof("serving the admission webhook on %s", address)
+			if err := admissionSrv.ListenAndServeTLS(cfg.Admission.CertFile, cfg.Admission.KeyFile); err != http.ErrServerClosed {
+				logrus.Fatal(err)
+			}
+		}()
+	}
+
+	go func() {
+		if !cache.WaitForCacheSync(stopCh, controller.HasSynced) {
+			return
+		}
+		atomic.StoreInt32(&synced, 1)
+
+		resyncPeriod := cfg.Controller.ResyncPeriod.Duration
+		if resyncPeriod <= 0 {
+			for _, service := range listServices(store) {
+				upsertService(ctx, service, domainNameTPR)
+			}
+			return
+		}
+		// periodically reconcile all the services, batching the changes per
+		// zone, starting with the services listed before the sync
+		wait.Until(func() {
+			services := listServices(store)
+			// results of the same service are spread over the zones
+			var reconciled []*v1.Service
+			results := map[*v1.Service][]dnscontroller.ProviderResult{}
+			for _, result := range dnscontroller.Reconcile(ctx, services) {
+				logResult(result.Service, result.ProviderResult)
+				if _, ok := results[result.Service]; !ok {
+					reconciled = append(reconciled, result.Service)
+				}
+				results[result.Service] = append(results[result.Service], result.ProviderResult)
+			}
+			for _, service := range reconciled {
+				if err := updateDomainName(service, results[service], domainNameTPR); err != nil {
+					logrus.Errorf("%s: DomainName TPR could not updated: %v", service.Name, err)
+				}
+			}
+		}, resyncPeriod, stopCh)
+	}()
+
+	srv := &http.Server{
+		Addr:    cfg.Server.Address,
+		Handler: router,
+	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		logrus.Infof("received %s, shutting down", sig)
+		cancel()
+		if admissionSrv != nil {
+			if err := admissionSrv.Shutdown(context.Background()); err != nil {
+				logrus.Errorf("could not shut down the admission webhook: %v", err)
+			}
+		}
+		if err := srv.Shutdown(context.Background()); err != nil {
+			logrus.Errorf("could not shut down the HTTP server: %v", err)
+		}
+	}()
 
 	//Keep alive
-	logrus.Fatal(http.ListenAndServe(":8080", server.NewRouter(version, buildDate)))
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logrus.Fatal(err)
+	}
+}
+
+// upsertService publishes the service to its providers and records the
+// outcome of each one in the DomainName TPR
+func upsertService(ctx context.Context, service *v1.Service, domainNameTPR *dnstpr.DomainNameResource) {
+	results, err := dnscontroller.UpsertToDNSProvider(ctx, service)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	for _, result := range results {
+		logResult(service, result)
+	}
+	if err := updateDomainName(service, results, domainNameTPR); err != nil {
+		logrus.Errorf("%s: DomainName TPR could not updated: %v", service.Name, err)
+	}
+}
+
+// released returns the claimants that no longer share a name with the service
+func released(before, after []*v1.Service) []*v1.Service {
+	var services []*v1.Service
+	for _, b := range before {
+		found := false
+		for _, a := range after {
+			if a.Namespace == b.Namespace && a.Name == b.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			services = append(services, b)
+		}
+	}
+	return services
+}
+
+func listServices(store cache.Store) []*v1.Service {
+	var services []*v1.Service
+	for _, obj := range store.List() {
+		services = append(services, obj.(*v1.Service))
+	}
+	return services
+}
+
+func logResult(service *v1.Service, result dnscontroller.ProviderResult) {
+	if result.Err != nil {
+		logrus.Error(result.Err)
+	} else if result.Changed {
+		logrus.Infof("%s: provider %s DNS record changed succesfully", service.Name, result.Provider)
+	}
 }
 
-func createOrUpdateDomainNameTPR(service *v1.Service, providerRecord *dnsprovider.DnsRecord, domainNameTPR *dnstpr.DomainNameResource) error {
-	tpr := &dnstpr.DomainName{
+// updateDomainName writes the record and the status of each provider of the
+// service to its DomainName TPR, only when one of them changed. Providers no
+// longer used by the service are dropped from the status.
+func updateDomainName(service *v1.Service, results []dnscontroller.ProviderResult, domainNameTPR *dnstpr.DomainNameResource) error {
+	existing, err := domainNameTPR.Get(service.Name, service.Namespace)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	domainName := &dnstpr.DomainName{
 		Metadata: metav1.ObjectMeta{
 			Name:      service.Name,
 			Namespace: service.Namespace,
 		},
 		Spec: dnstpr.DomainNameSpec{
 			ServiceName: service.Name,
-			Record: dnstpr.Record{
-				FQDN:      providerRecord.Fqdn,
-				Endpoints: providerRecord.Records,
-				Type:      providerRecord.Type,
-				TTL:       providerRecord.TTL,
-			},
 		},
 	}
-	_, err := domainNameTPR.CreateOrUpdate(tpr, service.Namespace)
+	if existing != nil {
+		domainName.Spec = existing.Spec
+	}
+
+	hasRecord := existing != nil
+	for _, result := range results {
+		if status := existingStatus(existing, result.Provider); status != nil {
+			domainName.Status.Providers = append(domainName.Status.Providers, *status)
+		}
+		// nothing was synced with the provider, e.g. the service has no IPs yet
+		if result.Err == nil && result.Record == nil {
+			continue
+		}
+		if result.Record != nil {
+			domainName.Spec.Record = domainNameRecord(result.Record)
+			hasRecord = true
+		}
+		// report the name is taken even if the service never had a record
+		if _, ok := result.Err.(*dnscontroller.ConflictError); ok {
+			hasRecord = true
+		}
+		errMsg := ""
+		if result.Err != nil {
+			errMsg = result.Err.Error()
+		}
+		domainName.Status.SetProviderStatus(result.Provider, result.Err == nil, errMsg)
+	}
+	if !hasRecord {
+		return nil
+	}
+	if existing != nil && reflect.DeepEqual(existing.Spec, domainName.Spec) && reflect.DeepEqual(existing.Status, domainName.Status) {
+		return nil
+	}
 
+	_, err = domainNameTPR.CreateOrUpdate(domainName, service.Namespace)
 	return err
 }
 
+func existingStatus(domainName *dnstpr.DomainName, provider string) *dnstpr.ProviderStatus {
+	if domainName == nil {
+		return nil
+	}
+	return domainName.Status.GetProviderStatus(provider)
+}
+
+func domainNameRecord(providerRecord *dnsprovider.DnsRecord) dnstpr.Record {
+	return dnstpr.Record{
+		FQDN:      providerRecord.Fqdn,
+		Endpoints: providerRecord.Records,
+		Type:      providerRecord.Type,
+		TTL:       providerRecord.TTL,
+
+		PrivateEndpoints: providerRecord.PrivateRecords,
+		SetIdentifier:    providerRecord.SetIdentifier,
+	}
+}
+
 func buildKubecConfig() (*rest.Config, error) {
 	// use the provided file or setup an in-cluster config
 	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
@@ -0,0 +1,180 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Actions of the entries
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// Stdout is the output writing the entries to the standard output
+const Stdout = "stdout"
+
+// entries kept in memory to answer queries when writing to the standard output
+const maxRecent = 1000
+
+// Object is the Kubernetes object a change was made for
+type Object struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+}
+
+// Entry is a record created, updated or deleted in a provider
+type Entry struct {
+	Time          time.Time `json:"time"`
+	Action        string    `json:"action"`
+	Provider      string    `json:"provider"`
+	Zone          string    `json:"zone"`
+	FQDN          string    `json:"fqdn"`
+	Type          string    `json:"type"`
+	SetIdentifier string    `json:"setIdentifier,omitempty"`
+	OldValues     []string  `json:"oldValues,omitempty"`
+	NewValues     []string  `json:"newValues,omitempty"`
+	Object        Object    `json:"object"`
+	// Reason is what made the controller sync the object, e.g. its deletion
+	Reason string `json:"reason"`
+	// Error is set if the provider did not accept the change
+	Error string `json:"error,omitempty"`
+}
+
+// Log appends the entries as JSON lines to a file or the standard output
+type Log struct {
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+	// the latest entries when there is no file to read them back from
+	recent []Entry
+}
+
+// Open returns a log writing to the standard output or appending to the file
+func Open(output string) (*Log, error) {
+	if output == Stdout {
+		return &Log{w: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log '%s': %v", output, err)
+	}
+	return &Log{w: file, file: file}, nil
+}
+
+// Close closes the file of the log
+func (l *Log) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Record writes the entries, an entry that cannot be written is logged
+func (l *Log) Record(entries ...Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err == nil {
+			_, err = l.w.Write(append(data, '\n'))
+		}
+		if err != nil {
+			logrus.Errorf("could not write audit log entry for '%s': %v", entry.FQDN, err)
+			continue
+		}
+		if l.file == nil {
+			l.recent = append(l.recent, entry)
+			if len(l.recent) > maxRecent {
+				l.recent = l.recent[len(l.recent)-maxRecent:]
+			}
+		}
+	}
+}
+
+// Query selects entries, empty fields match every entry
+type Query struct {
+	FQDN      string
+	Zone      string
+	Provider  string
+	Namespace string
+	Name      string
+	Since     time.Time
+	Until     time.Time
+	// Limit keeps the latest entries only, 0 keeps all of them
+	Limit int
+}
+
+func (q Query) matches(e Entry) bool {
+	return (q.FQDN == "" || q.FQDN == e.FQDN) &&
+		(q.Zone == "" || q.Zone == e.Zone) &&
+		(q.Provider == "" || q.Provider == e.Provider) &&
+		(q.Namespace == "" || q.Namespace == e.Object.Namespace) &&
+		(q.Name == "" || q.Name == e.Object.Name) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// Find returns the matching entries, oldest first. The file is read back,
+// only the latest entries are kept in memory for the standard output. The
+// entries written while the file is read are left out so Record does not wait
+// for the query.
+func (l *Log) Find(q Query) ([]Entry, error) {
+	var found []Entry
+	add := func(e Entry) {
+		if !q.matches(e) {
+			return
+		}
+		found = append(found, e)
+		if q.Limit > 0 && len(found) > q.Limit {
+			found = found[1:]
+		}
+	}
+
+	l.mu.Lock()
+	if l.file == nil {
+		recent := make([]Entry, len(l.recent))
+		copy(recent, l.recent)
+		l.mu.Unlock()
+		for _, e := range recent {
+			add(e)
+		}
+		return found, nil
+	}
+	// whole lines only, Record writes an entry with a single write
+	info, err := l.file.Stat()
+	l.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("could not read audit log: %v", err)
+	}
+
+	file, err := os.Open(l.file.Name())
+	if err != nil {
+		return nil, fmt.Errorf("could not read audit log: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(io.LimitReader(file, info.Size()))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a line cut short by a crash does not hide the others
+			continue
+		}
+		add(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read audit log: %v", err)
+	}
+	return found, nil
+}
@@ -0,0 +1,440 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+
+	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// Version is the only configuration file version currently understood
+const Version = "v1"
+
+// Environment variables that override values from the configuration file
+const (
+	ConfigPathEnv    = "EXTERNAL_DNS_CONFIG"
+	ListenAddressEnv = "EXTERNAL_DNS_LISTEN_ADDRESS"
+	DefaultTTLEnv    = "EXTERNAL_DNS_TTL"
+)
+
+// Config describes the provider accounts, zones and controller options
+type Config struct {
+	Version       string              `json:"version"`
+	Server        ServerConfig        `json:"server"`
+	Controller    ControllerConfig    `json:"controller"`
+	Defaults      DefaultsConfig      `json:"defaults"`
+	Filters       FiltersConfig       `json:"filters"`
+	Admission     AdmissionConfig     `json:"admission"`
+	Audit         AuditConfig         `json:"audit"`
+	Notifications NotificationsConfig `json:"notifications"`
+	Providers     []ProviderConfig    `json:"providers"`
+}
+
+// ServerConfig holds the settings of the HTTP server
+type ServerConfig struct {
+	Address string `json:"address"`
+}
+
+// ControllerConfig holds the settings of the service informer
+type ControllerConfig struct {
+	ResyncPeriod Duration `json:"resyncPeriod"`
+	// OperationTimeout bounds the provider calls made for a single service
+	OperationTimeout Duration `json:"operationTimeout"`
+	// ZoneCacheTTL is how long the records listed from a zone are reused, 0
+	// disables the cache
+	ZoneCacheTTL Duration `json:"zoneCacheTTL"`
+	// ZoneRefreshPeriod is how often the zones of the provider accounts are
+	// listed again to find the zone of a hostname
+	ZoneRefreshPeriod Duration `json:"zoneRefreshPeriod"`
+}
+
+// DefaultsConfig holds the values used when a service does not set its own
+type DefaultsConfig struct {
+	// TTL of 0 lets the provider default to its minimum
+	TTL int `json:"ttl"`
+	// RecordType is the type of the records created for a service, "A" or "AAAA"
+	RecordType string `json:"recordType"`
+}
+
+// FiltersConfig limits which services are managed
+type FiltersConfig struct {
+	Namespaces        []string `json:"namespaces"`
+	ExcludeNamespaces []string `json:"excludeNamespaces"`
+}
+
+// AdmissionConfig holds the settings of the validating admission webhook
+// server, the API server only calls webhooks over HTTPS
+type AdmissionConfig struct {
+	// Address is the listen address of the webhook, empty disables it
+	Address  string `json:"address"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+// AuditConfig holds the settings of the log of the changes made to records
+type AuditConfig struct {
+	// Output is "stdout" or the path of the file the entries are appended to,
+	// empty disables the audit log
+	Output string `json:"output"`
+}
+
+// NotificationsConfig holds the webhooks notified of record changes and sync
+// failures
+type NotificationsConfig struct {
+	// FailureThreshold is the number of syncs of a service with a provider in
+	// a row that have to fail before the failure is notified
+	FailureThreshold int             `json:"failureThreshold"`
+	Webhooks         []WebhookConfig `json:"webhooks"`
+}
+
+// WebhookConfig describes an HTTP endpoint notifications are posted to
+type WebhookConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Format is the name of a registered formatter, defaults to "json"
+	Format string `json:"format"`
+	// Events are the notified event types, all of them when empty
+	Events []string `json:"events"`
+	// Zones restricts the notifications to records in these root domains
+	Zones   []string          `json:"zones"`
+	Headers map[string]string `json:"headers"`
+	// MaxRetries is the number of times a failed post is sent again
+	MaxRetries int      `json:"maxRetries"`
+	Timeout    Duration `json:"timeout"`
+}
+
+// ProviderConfig describes a single DNS provider account
+type ProviderConfig struct {
+	// Name is the value of the provider annotation
+	Name string `json:"name"`
+	// Type is the registered provider type, defaults to Name
+	Type string `json:"type"`
+	// Options are provider specific settings such as credentials, keyed by the
+	// environment variable names the provider reads
+	Options map[string]string `json:"options"`
+	// SecretRef points to a Kubernetes secret whose keys are merged over Options
+	SecretRef *SecretRef `json:"secretRef"`
+	// Zones restricts the root domains that may be managed with this account
+	Zones []ZoneConfig `json:"zones"`
+}
+
+// ZoneConfig is a root domain with options that override the provider options
+// for that zone only, it can also be written as a plain string
+type ZoneConfig struct {
+	Name    string            `json:"name"`
+	Options map[string]string `json:"options"`
+}
+
+type zoneConfigCopy ZoneConfig
+
+func (z *ZoneConfig) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*z = ZoneConfig{Name: name}
+		return nil
+	}
+	var tmp zoneConfigCopy
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return fmt.Errorf("zone must be a name or an object with a name and options: %v", err)
+	}
+	*z = ZoneConfig(tmp)
+	return nil
+}
+
+// SecretRef references a secret by namespace and name
+type SecretRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// Duration is a time.Duration read from strings such as "30s" or "5m"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// Default returns the configuration used when no file is provided
+func Default() *Config {
+	return &Config{
+		Version: Version,
+		Server: ServerConfig{
+			Address: ":8080",
+		},
+		Controller: ControllerConfig{
+			OperationTimeout:  Duration{30 * time.Second},
+			ZoneCacheTTL:      Duration{time.Minute},
+			ZoneRefreshPeriod: Duration{10 * time.Minute},
+		},
+		Defaults: DefaultsConfig{
+			TTL:        0,
+			RecordType: "A",
+		},
+		Notifications: NotificationsConfig{
+			FailureThreshold: 3,
+		},
+	}
+}
+
+// Load reads the file set with EXTERNAL_DNS_CONFIG, if any, applies the
+// environment overrides and validates the result
+func Load() (*Config, error) {
+	cfg := Default()
+	if path := os.Getenv(ConfigPathEnv); path != "" {
+		var err error
+		if cfg, err = LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.normalize()
+	return cfg, nil
+}
+
+// normalize writes the zone names the way the controller writes root domains,
+// so they compare equal whatever their case. Validate reports invalid names.
+func (cfg *Config) normalize() {
+	for i := range cfg.Providers {
+		for j, zone := range cfg.Providers[i].Zones {
+			if name, err := dnsprovider.NormalizeHostname(zone.Name); err == nil {
+				cfg.Providers[i].Zones[j].Name = name
+			}
+		}
+	}
+}
+
+// LoadFile parses a YAML configuration file on top of the defaults, keys that
+// are not part of the configuration are rejected so that a misspelled option
+// is not silently ignored
+func LoadFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file '%s': %v", path, err)
+	}
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file '%s': %v", path, err)
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("could not parse config file '%s': %v", path, err)
+	}
+	if unknown := unknownKeys(raw, reflect.TypeOf(Config{}), ""); len(unknown) > 0 {
+		return nil, fmt.Errorf("config file '%s' has unknown keys: %s", path, strings.Join(unknown, ", "))
+	}
+
+	cfg := Default()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("could not parse config file '%s': %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) applyEnv() error {
+	if address := os.Getenv(ListenAddressEnv); address != "" {
+		cfg.Server.Address = address
+	}
+	if ttlStr := os.Getenv(DefaultTTLEnv); ttlStr != "" {
+		ttl, err := strconv.Atoi(ttlStr)
+		if err != nil {
+			return fmt.Errorf("%s must be a number of seconds: %v", DefaultTTLEnv, err)
+		}
+		cfg.Defaults.TTL = ttl
+	}
+	return nil
+}
+
+// Validate checks the configuration and reports every problem found
+func (cfg *Config) Validate() error {
+	var errs []string
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if cfg.Version != Version {
+		addErr("version: unsupported version '%s', expected '%s'", cfg.Version, Version)
+	}
+	if cfg.Server.Address == "" {
+		addErr("server.address: cannot be empty")
+	}
+	if cfg.Controller.ResyncPeriod.Duration < 0 {
+		addErr("controller.resyncPeriod: cannot be negative")
+	}
+	if cfg.Controller.OperationTimeout.Duration <= 0 {
+		addErr("controller.operationTimeout: must be greater than 0")
+	}
+	if cfg.Controller.ZoneCacheTTL.Duration < 0 {
+		addErr("controller.zoneCacheTTL: cannot be negative")
+	}
+	if cfg.Controller.ZoneRefreshPeriod.Duration <= 0 {
+		addErr("controller.zoneRefreshPeriod: must be greater than 0")
+	}
+	if cfg.Defaults.TTL < 0 {
+		addErr("defaults.ttl: cannot be negative")
+	}
+	switch cfg.Defaults.RecordType {
+	case "A", "AAAA":
+	default:
+		addErr("defaults.recordType: unsupported type '%s', expected 'A' or 'AAAA'", cfg.Defaults.RecordType)
+	}
+	for _, ns := range cfg.Filters.ExcludeNamespaces {
+		if contains(cfg.Filters.Namespaces, ns) {
+			addErr("filters.excludeNamespaces: namespace '%s' is also listed in filters.namespaces", ns)
+		}
+	}
+
+	if cfg.Admission.Address != "" {
+		if cfg.Admission.CertFile == "" {
+			addErr("admission.certFile: cannot be empty when admission.address is set")
+		}
+		if cfg.Admission.KeyFile == "" {
+			addErr("admission.keyFile: cannot be empty when admission.address is set")
+		}
+	}
+	if cfg.Notifications.FailureThreshold < 1 {
+		addErr("notifications.failureThreshold: must be at least 1")
+	}
+	for i, w := range cfg.Notifications.Webhooks {
+		field := fmt.Sprintf("notifications.webhooks[%d]", i)
+		if w.URL == "" {
+			addErr("%s.url: cannot be empty", field)
+		}
+		if w.MaxRetries < 0 {
+			addErr("%s.maxRetries: cannot be negative", field)
+		}
+		if w.Timeout.Duration < 0 {
+			addErr("%s.timeout: cannot be negative", field)
+		}
+	}
+
+	names := map[string]int{}
+	for i, p := range cfg.Providers {
+		field := fmt.Sprintf("providers[%d]", i)
+		if p.Name == "" {
+			addErr("%s.name: cannot be empty", field)
+		} else if j, exists := names[p.Name]; exists {
+			addErr("%s.name: '%s' is already used by providers[%d]", field, p.Name, j)
+		} else {
+			names[p.Name] = i
+		}
+		if providerType := p.ProviderType(); providerType != "" && !dnsprovider.Registered(providerType) {
+			addErr("%s.type: unknown provider type '%s'", field, providerType)
+		}
+		if p.SecretRef != nil && p.SecretRef.Name == "" {
+			addErr("%s.secretRef.name: cannot be empty", field)
+		}
+		for j, zone := range p.Zones {
+			if strings.TrimSpace(zone.Name) == "" {
+				addErr("%s.zones[%d].name: cannot be empty", field, j)
+			} else if _, err := dnsprovider.NormalizeHostname(zone.Name); err != nil {
+				addErr("%s.zones[%d].name: %v", field, j, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// Provider returns the configuration of the named provider account
+func (cfg *Config) Provider(name string) (*ProviderConfig, bool) {
+	for i := range cfg.Providers {
+		if cfg.Providers[i].Name == name {
+			return &cfg.Providers[i], true
+		}
+	}
+	return nil, false
+}
+
+// ProviderType returns the provider type, which defaults to the account name
+func (p *ProviderConfig) ProviderType() string {
+	if p.Type == "" {
+		return p.Name
+	}
+	return p.Type
+}
+
+// SecretNamespace returns the namespace of the referenced secret
+func (r *SecretRef) SecretNamespace() string {
+	if r.Namespace == "" {
+		return "default"
+	}
+	return r.Namespace
+}
+
+// AllowsZone returns true if the root domain may be managed with this account
+func (p *ProviderConfig) AllowsZone(rootDomain string) bool {
+	if len(p.Zones) == 0 {
+		return true
+	}
+	rootDomain = strings.TrimSuffix(rootDomain, ".")
+	for _, zone := range p.Zones {
+		if strings.EqualFold(strings.TrimSuffix(zone.Name, "."), rootDomain) {
+			return true
+		}
+	}
+	return false
+}
+
+// ZoneOptions returns the options of the zones that override any, keyed by
+// the zone name
+func (p *ProviderConfig) ZoneOptions() map[string]map[string]string {
+	zoneOptions := map[string]map[string]string{}
+	for _, zone := range p.Zones {
+		if len(zone.Options) > 0 {
+			zoneOptions[strings.ToLower(strings.TrimSuffix(zone.Name, "."))] = zone.Options
+		}
+	}
+	return zoneOptions
+}
+
+// AllowsNamespace returns true if services in the namespace should be managed
+func (f *FiltersConfig) AllowsNamespace(namespace string) bool {
+	if contains(f.ExcludeNamespaces, namespace) {
+		return false
+	}
+	return len(f.Namespaces) == 0 || contains(f.Namespaces, namespace)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
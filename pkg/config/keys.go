@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// unknownKeys returns the paths of the keys of the decoded JSON value that no
+// field of the type reads, such as "providers[0].zone". Keys are matched to
+// fields the way encoding/json does, ignoring case.
+func unknownKeys(value interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var unknown []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Map:
+			for _, key := range sortedKeys(v) {
+				unknown = append(unknown, unknownKeys(v[key], t.Elem(), path+"."+key)...)
+			}
+		case reflect.Struct:
+			fields := jsonFields(t)
+			for _, key := range sortedKeys(v) {
+				field, ok := fields[strings.ToLower(key)]
+				if !ok {
+					unknown = append(unknown, strings.TrimPrefix(path+"."+key, "."))
+					continue
+				}
+				unknown = append(unknown, unknownKeys(v[key], field.Type, path+"."+key)...)
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, item := range v {
+				unknown = append(unknown, unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+	return unknown
+}
+
+// jsonFields returns the fields of the struct keyed by their lower case JSON
+// name
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field
+	}
+	return fields
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
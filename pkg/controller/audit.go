@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/audit"
+	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// reasons of the changes written to the audit log
+const (
+	reasonServiceChanged = "service added or updated"
+	reasonServiceDeleted = "service deleted"
+	reasonResync         = "periodic resync"
+)
+
+var auditLog *audit.Log
+
+// SetAuditLog sets the log every change made to the providers is written to
+func SetAuditLog(l *audit.Log) {
+	auditLog = l
+}
+
+// apply sends the changes to the provider and reports them, found holds the
+// records as they were before the changes
+func (mngr *DNSController) apply(ctx context.Context, changes dnsprovider.Changes, found ...dnsprovider.DnsRecord) error {
+	err := dnsprovider.ApplyChanges(ctx, mngr.Provider, changes)
+	reportChanges(mngr.Service, Target{Provider: mngr.ProviderName, RootDomain: mngr.Zone}, mngr.reason, changes, found, err)
+	return err
+}
+
+// reportChanges writes an entry for every record of the changes made for the
+// service to the audit log and notifies them, err is the error of the
+// provider if it rejected them
+func reportChanges(service *v1.Service, target Target, reason string, changes dnsprovider.Changes, found []dnsprovider.DnsRecord, err error) {
+	if auditLog == nil && notifier == nil || changes.Empty() {
+		return
+	}
+	old := make(map[string]dnsprovider.DnsRecord, len(found))
+	for _, r := range found {
+		old[recordKey(r)] = r
+	}
+
+	now := time.Now().UTC()
+	entry := func(action string, record dnsprovider.DnsRecord) audit.Entry {
+		e := audit.Entry{
+			Time:          now,
+			Action:        action,
+			Provider:      target.Provider,
+			Zone:          target.RootDomain,
+			FQDN:          dnsprovider.UnFqdn(record.Fqdn),
+			Type:          record.Type,
+			SetIdentifier: record.SetIdentifier,
+			Reason:        reason,
+		}
+		if service != nil {
+			e.Object = audit.Object{Kind: "Service", Namespace: service.Namespace, Name: service.Name, UID: string(service.UID)}
+		}
+		if r, ok := old[recordKey(record)]; ok {
+			e.OldValues = r.Records
+		} else if action == audit.ActionDelete {
+			e.OldValues = record.Records
+		}
+		if action != audit.ActionDelete {
+			e.NewValues = record.Records
+		}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		return e
+	}
+
+	var entries []audit.Entry
+	for _, record := range changes.Create {
+		entries = append(entries, entry(audit.ActionCreate, record))
+	}
+	for _, record := range changes.Update {
+		entries = append(entries, entry(audit.ActionUpdate, record))
+	}
+	for _, record := range changes.Delete {
+		entries = append(entries, entry(audit.ActionDelete, record))
+	}
+	if auditLog != nil {
+		auditLog.Record(entries...)
+	}
+	notifyChanges(entries)
+}
@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// the services known to the controller keyed by namespace/name, and the ones
+// claiming each name, so a conflict is found without computing the claims of
+// every other service
+var claimIndex = struct {
+	sync.Mutex
+	services  map[string]indexedService
+	claimants map[claim]map[string]*v1.Service
+}{
+	services:  map[string]indexedService{},
+	claimants: map[claim]map[string]*v1.Service{},
+}
+
+type indexedService struct {
+	service *v1.Service
+	claims  []claim
+}
+
+// IndexService records the names the service claims, it must be called for
+// every service added or updated. A name claimed by several services is only
+// published for one.
+func IndexService(ctx context.Context, service *v1.Service) {
+	claims := claimsOf(ctx, service)
+	claimIndex.Lock()
+	defer claimIndex.Unlock()
+	unindex(service)
+	key := serviceKey(service)
+	claimIndex.services[key] = indexedService{service: service, claims: claims}
+	for _, c := range claims {
+		if claimIndex.claimants[c] == nil {
+			claimIndex.claimants[c] = map[string]*v1.Service{}
+		}
+		claimIndex.claimants[c][key] = service
+	}
+}
+
+// UnindexService forgets the names of a deleted service
+func UnindexService(service *v1.Service) {
+	claimIndex.Lock()
+	defer claimIndex.Unlock()
+	unindex(service)
+}
+
+// unindex removes the service from the index, the lock must be held
+func unindex(service *v1.Service) {
+	key := serviceKey(service)
+	indexed, ok := claimIndex.services[key]
+	if !ok {
+		return
+	}
+	for _, c := range indexed.claims {
+		delete(claimIndex.claimants[c], key)
+		if len(claimIndex.claimants[c]) == 0 {
+			delete(claimIndex.claimants, c)
+		}
+	}
+	delete(claimIndex.services, key)
+}
+
+// claimantsOf returns the services other than service claiming the name
+func claimantsOf(service *v1.Service, c claim) []*v1.Service {
+	claimIndex.Lock()
+	defer claimIndex.Unlock()
+	var claimants []*v1.Service
+	for _, other := range claimIndex.claimants[c] {
+		if !sameService(other, service) {
+			claimants = append(claimants, other)
+		}
+	}
+	return claimants
+}
+
+func serviceKey(service *v1.Service) string {
+	return service.Namespace + "/" + service.Name
+}
+
+// ConflictError is returned for a service claiming a name that is already
+// published for another service
+type ConflictError struct {
+	Service string
+	Fqdn    string
+	// namespace/name of the service owning the name
+	Owner string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: '%s' is already published for service %s which was created first", e.Service, e.Fqdn, e.Owner)
+}
+
+// claim is a record name of a service in a zone, services with different set
+// identifiers share a name through a routing policy
+type claim struct {
+	target        Target
+	fqdn          string
+	setIdentifier string
+}
+
+// claimsOf returns the names the service publishes, a service without load
+// balancer ingress or with invalid annotations does not claim any
+func claimsOf(ctx context.Context, service *v1.Service) []claim {
+	if len(service.Status.LoadBalancer.Ingress) == 0 {
+		return nil
+	}
+	targets, err := GetTargets(ctx, service)
+	if err != nil {
+		return nil
+	}
+	setIdentifier, _, err := getRoutingPolicy(service)
+	if err != nil {
+		return nil
+	}
+	var claims []claim
+	for _, target := range targets {
+		if fqdn, err := getFqdn(service, target.RootDomain); err == nil {
+			claims = append(claims, claim{target: target, fqdn: fqdn, setIdentifier: setIdentifier})
+		}
+	}
+	return claims
+}
+
+// checkConflict returns a ConflictError if another service claims the same
+// name. The service created first owns it, the others are never published so
+// the record does not flap between them, unless both the owner and the service
+// merge their records.
+func checkConflict(ctx context.Context, service *v1.Service, c claim) error {
+	var owner *v1.Service
+	for _, other := range claimantsOf(service, c) {
+		if createdBefore(other, service) && (owner == nil || createdBefore(other, owner)) {
+			owner = other
+		}
+	}
+	if owner == nil {
+		return nil
+	}
+	if merge, _ := getMerge(service); merge {
+		if ownerMerge, _ := getMerge(owner); ownerMerge {
+			return nil
+		}
+	}
+	return &ConflictError{Service: service.Name, Fqdn: c.fqdn, Owner: owner.Namespace + "/" + owner.Name}
+}
+
+// Claimants returns the other services claiming one of the names of the
+// service, one of them takes the name over once the service is deleted
+func Claimants(ctx context.Context, service *v1.Service) []*v1.Service {
+	claimIndex.Lock()
+	indexed, ok := claimIndex.services[serviceKey(service)]
+	claimIndex.Unlock()
+	claims := indexed.claims
+	if !ok {
+		claims = claimsOf(ctx, service)
+	}
+
+	seen := map[string]bool{}
+	var claimants []*v1.Service
+	for _, c := range claims {
+		for _, other := range claimantsOf(service, c) {
+			if key := serviceKey(other); !seen[key] {
+				seen[key] = true
+				claimants = append(claimants, other)
+			}
+		}
+	}
+	return claimants
+}
+
+func sameService(x, y *v1.Service) bool {
+	return x.Namespace == y.Namespace && x.Name == y.Name
+}
+
+// createdBefore orders the services by creation, the namespace and name break
+// ties so every controller picks the same owner
+func createdBefore(x, y *v1.Service) bool {
+	tx, ty := x.CreationTimestamp.Time, y.CreationTimestamp.Time
+	if !tx.Equal(ty) {
+		return tx.Before(ty)
+	}
+	if x.Namespace != y.Namespace {
+		return x.Namespace < y.Namespace
+	}
+	return x.Name < y.Name
+}
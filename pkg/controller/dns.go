@@ -2,21 +2,69 @@ package dns
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 
 	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
 	"k8s.io/client-go/pkg/api/v1"
 
+	"github.com/dkoshkin/kube-external-dns/pkg/config"
 	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
 )
 
 var providerAnnotation = "external.dns.koshk.in/provider"
 var rootDomainAnnotation = "external.dns.koshk.in/root-domain"
-var subDomainAnnotation = "external.dns.koshk.in/sub-domain" //optional: name.namespace.$domain
+var subDomainAnnotation = "external.dns.koshk.in/sub-domain" //optional: name.namespace.$domain, "@" for the zone apex
 //var ttlAnnotation = "external.dns.koshk.in/TTL"              //optional: 120 seconds
 
-// UpsertToDNSProvider will create or update a record if exists, in an external DNS provider
-func UpsertToDNSProvider(service *v1.Service) (changed bool, record *dnsprovider.DnsRecord, err error) {
-	mngr, err := GetManager(service)
+var privateTargetAnnotation = "external.dns.koshk.in/private-target" //optional: "cluster-ip" for split-horizon private zones
+var proxiedAnnotation = "external.dns.koshk.in/proxied"              //optional: true or false, unset keeps the current setting
+
+var cfg = config.Default()
+
+// Configure sets the configuration used when parsing services
+func Configure(c *config.Config) {
+	cfg = c
+}
+
+// ProviderResult is the outcome of syncing a service with one provider
+type ProviderResult struct {
+	Provider string
+	// root domain of the zone of the record
+	Zone    string
+	Changed bool
+	Record  *dnsprovider.DnsRecord
+	Err     error
+}
+
+// UpsertToDNSProvider will create or update a record if exists, in every
+// external DNS provider of the service. A provider failing does not stop the
+// others, its error is in its result.
+func UpsertToDNSProvider(ctx context.Context, service *v1.Service) ([]ProviderResult, error) {
+	targets, err := GetTargets(ctx, service)
+	if err != nil {
+		recordError(service, err)
+		trackResult(service, ProviderResult{Err: err})
+		return nil, err
+	}
+	var results []ProviderResult
+	for _, target := range targets {
+		changed, record, err := upsert(ctx, service, target)
+		recordError(service, err)
+		result := ProviderResult{Provider: target.Provider, Zone: target.RootDomain, Changed: changed, Record: record, Err: err}
+		trackResult(service, result)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// every provider gets its own operation timeout
+func upsert(ctx context.Context, service *v1.Service, target Target) (changed bool, record *dnsprovider.DnsRecord, err error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Controller.OperationTimeout.Duration)
+	defer cancel()
+
+	mngr, err := GetManager(ctx, service, target)
 	if err != nil {
 		return false, nil, err
 	}
@@ -25,32 +73,65 @@ func UpsertToDNSProvider(service *v1.Service) (changed bool, record *dnsprovider
 		return false, nil, nil
 	}
 
+	mngr.reason = reasonServiceChanged
+	changed, err = mngr.upsertRecord(ctx)
+	if err != nil {
+		return changed, mngr.DNSRecord, err
+	}
+	srvChanged, err := mngr.syncSRVRecords(ctx)
+	return changed || srvChanged, mngr.DNSRecord, err
+}
+
+func (mngr *DNSController) upsertRecord(ctx context.Context) (bool, error) {
 	fqdn := mngr.DNSRecord.Fqdn
 	name := mngr.ServiceName
-	found, err := mngr.GetRecord()
+	found, err := mngr.GetRecord(ctx)
 	// check if record already exists
 	if err != nil {
-		return false, nil, fmt.Errorf("%s: could not determine if record '%s' exists: %v", name, fqdn, err)
+		return false, fmt.Errorf("%s: could not determine if record '%s' exists in %s: %v", name, fqdn, mngr.ProviderName, err)
 	}
 	if found == nil {
-		logrus.Infof("%s: is not already set, will be creating a new record", name)
-		err := mngr.InsertRecord()
-		return err == nil, mngr.DNSRecord, err
+		logrus.Infof("%s: is not already set in %s, will be creating a new record", name, mngr.ProviderName)
+		err := mngr.InsertRecord(ctx)
+		return err == nil, err
 	}
-	if !slicesSimilar(found.Records, mngr.DNSRecord.Records) {
-		logrus.Warnf("%s: is set but contains different records, will be updating it", name)
-		err := mngr.UpdateRecord()
-		return err == nil, mngr.DNSRecord, err
+	if !recordsMatch(mngr.Provider, *found, *mngr.DNSRecord) {
+		logrus.Warnf("%s: is set in %s but contains different records, will be updating it", name, mngr.ProviderName)
+		err := mngr.UpdateRecord(ctx, *found)
+		return err == nil, err
 	}
 
-	logrus.Infof("%s: is already configured, nothing to do", name)
+	logrus.Infof("%s: is already configured in %s, nothing to do", name, mngr.ProviderName)
+
+	return false, nil
+}
 
-	return false, mngr.DNSRecord, nil
+// DeleteToDNSProvider will delete the record from every provider of the service
+func DeleteToDNSProvider(ctx context.Context, service *v1.Service) ([]ProviderResult, error) {
+	targets, err := GetTargets(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	var results []ProviderResult
+	for _, target := range targets {
+		changed, record, err := remove(ctx, service, target)
+		result := ProviderResult{Provider: target.Provider, Zone: target.RootDomain, Changed: changed, Record: record, Err: err}
+		trackResult(service, result)
+		results = append(results, result)
+	}
+	return results, nil
 }
 
-// DeleteToDNSProvider will delete a record
-func DeleteToDNSProvider(service *v1.Service) (changed bool, record *dnsprovider.DnsRecord, err error) {
-	mngr, err := GetManager(service)
+func remove(ctx context.Context, service *v1.Service, target Target) (changed bool, record *dnsprovider.DnsRecord, err error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Controller.OperationTimeout.Duration)
+	defer cancel()
+
+	mngr, err := GetManager(ctx, service, target)
+	// the record belongs to the service created first
+	if conflict, ok := err.(*ConflictError); ok {
+		logrus.Infof("%s: record '%s' in %s is published for service %s, nothing to delete", service.Name, conflict.Fqdn, target.Provider, conflict.Owner)
+		return false, nil, nil
+	}
 	if err != nil {
 		return false, nil, err
 	}
@@ -59,126 +140,282 @@ func DeleteToDNSProvider(service *v1.Service) (changed bool, record *dnsprovider
 		return false, nil, nil
 	}
 
+	mngr.reason = reasonServiceDeleted
+	// other services merged into the record keep their IPs
+	if mngr.Remaining != nil {
+		logrus.Infof("%s: record '%s' in %s is shared with other services, will be removing the service IPs", service.Name, mngr.DNSRecord.Fqdn, target.Provider)
+		mngr.DNSRecord = mngr.Remaining
+		changed, err := mngr.upsertRecord(ctx)
+		return changed, mngr.DNSRecord, err
+	}
+
+	// the SRV records point at the record, remove them first
+	mngr.SRVRecords = nil
+	if _, err := mngr.syncSRVRecords(ctx); err != nil {
+		return false, mngr.DNSRecord, err
+	}
+
 	// check if record exists
 	name := mngr.ServiceName
 	fqdn := mngr.DNSRecord.Fqdn
-	found, err := mngr.GetRecord()
+	found, err := mngr.GetRecord(ctx)
 	if err != nil {
-		return false, nil, fmt.Errorf("%s: could not determine if record '%s' exists: %v", name, fqdn, err)
+		return false, nil, fmt.Errorf("%s: could not determine if record '%s' exists in %s: %v", name, fqdn, target.Provider, err)
 	}
+	// already gone, another provider failing should not keep it around
 	if found == nil {
-		return false, nil, fmt.Errorf("%s: expected record but it was not found", name)
+		logrus.Infof("%s: record not found in %s, nothing to delete", name, target.Provider)
+		return false, nil, nil
 	}
 
-	logrus.Infof("%s: record found, will be deleting it", name)
-	err = mngr.DeleteRecord()
+	logrus.Infof("%s: record found in %s, will be deleting it", name, target.Provider)
+	err = mngr.DeleteRecord(ctx, *found)
 	return err == nil, mngr.DNSRecord, err
 }
 
-// GetManager parses the v1.Service object and returns a DNS manager
-func GetManager(service *v1.Service) (*DNSController, error) {
-	if service == nil {
-		logrus.Warn("service object is nil")
-		return nil, nil
-	}
-	// get details from annotations
+// GetManager parses the v1.Service object and returns a DNS manager for the
+// provider and zone of the target
+func GetManager(ctx context.Context, service *v1.Service, target Target) (*DNSController, error) {
+	return newManager(ctx, service, target, dnsprovider.GetProvider)
+}
+
+// newManager returns the DNS manager of the target with the provider returned
+// by getProvider, which is only called once the annotations are valid
+func newManager(ctx context.Context, service *v1.Service, target Target, getProvider func(ctx context.Context, name, rootDomainName string) (dnsprovider.Provider, error)) (*DNSController, error) {
 	annotations := service.Annotations
-	providerStr, ok := annotations[providerAnnotation]
-	if !ok {
-		logrus.Infof("%s: service resource does not have the annotation '%s'", service.Name, providerAnnotation)
-		return nil, nil
-	}
-	rootDomain := annotations[rootDomainAnnotation]
-	if len(rootDomain) == 0 {
-		return nil, fmt.Errorf("%s: service resource annotation '%s' cannot be empty", service.Name, providerAnnotation)
+	providerStr, rootDomain := target.Provider, target.RootDomain
+	if providerCfg, ok := cfg.Provider(providerStr); ok && !providerCfg.AllowsZone(rootDomain) {
+		return nil, fmt.Errorf("%s: root domain '%s' is not one of the zones configured for provider '%s'", service.Name, rootDomain, providerStr)
 	}
-	var records []string
-	// 	TODO use real LB IPs
-	// if len(service.Spec.ClusterIP) > 0 {
-	// 	records = append(records, service.Spec.ClusterIP)
-	// }
-	if service.Status.LoadBalancer.Ingress != nil {
-		lbRecords := service.Status.LoadBalancer.Ingress
-		for _, r := range lbRecords {
-			if len(r.IP) > 0 {
-				records = append(records, r.IP)
-			}
-		}
+	// nothing reaches the provider before the name is validated
+	fqdn, err := getFqdn(service, rootDomain)
+	if err != nil {
+		return nil, err
 	}
-	if len(records) == 0 {
+
+	recordType := cfg.Defaults.RecordType
+	records, hostnames := getIngress(service, recordType)
+	if len(records) == 0 && len(hostnames) == 0 {
 		logrus.Warnf("%s: service does not have valid IP records, this could mean its just not ready yet", service.Name)
 		return nil, nil
 	}
+	privateRecords, err := getPrivateRecords(service, recordType)
+	if err != nil {
+		return nil, err
+	}
 
-	dnsProvider, err := dnsprovider.GetProvider(providerStr, rootDomain)
+	setIdentifier, routing, err := getRoutingPolicy(service)
 	if err != nil {
-		return nil, fmt.Errorf("%s: error getting provider: %v", service.Name, err)
+		return nil, err
 	}
-	subDomain := fmt.Sprintf("%s.%s", service.Name, service.Namespace)
-	// allow to overwire default subDomain
-	if subDomainStr := annotations[subDomainAnnotation]; len(subDomainStr) > 0 {
-		subDomain = subDomainStr
+	merge, err := getMerge(service)
+	if err != nil {
+		return nil, err
+	}
+	c := claim{target: target, fqdn: fqdn, setIdentifier: setIdentifier}
+	if err := checkConflict(ctx, service, c); err != nil {
+		return nil, err
 	}
 
-	fqdn := fmt.Sprintf("%s.%s", subDomain, rootDomain)
+	dnsProvider, err := getProvider(ctx, providerStr, rootDomain)
+	if err != nil {
+		return nil, fmt.Errorf("%s: error getting provider: %v", service.Name, err)
+	}
+	if _, ok := dnsProvider.(dnsprovider.RecordSetProvider); len(setIdentifier) > 0 && !ok {
+		return nil, fmt.Errorf("%s: provider %s does not support routing policies", service.Name, dnsProvider.GetName())
+	}
+	// load balancers that only have a hostname can be aliased by some providers
+	alias := false
+	if len(records) == 0 {
+		aliaser, ok := dnsProvider.(dnsprovider.AliasProvider)
+		if !ok || !aliaser.CanAlias(hostnames[0]) {
+			logrus.Warnf("%s: service load balancer only has the hostname '%s' which provider %s cannot alias", service.Name, hostnames[0], dnsProvider.GetName())
+			return nil, nil
+		}
+		if len(hostnames) > 1 {
+			logrus.Warnf("%s: service has %d load balancer hostnames, only '%s' will be aliased", service.Name, len(hostnames), hostnames[0])
+		}
+		if merge {
+			return nil, fmt.Errorf("%s: service resource annotation '%s' requires load balancer IPs, hostnames cannot be merged", service.Name, mergeAnnotation)
+		}
+		records = hostnames[:1]
+		alias = true
+	}
+	healthCheck, err := getHealthCheck(service, dnsProvider)
+	if err != nil {
+		return nil, err
+	}
+	var proxied *bool
+	if value, ok := annotations[proxiedAnnotation]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: service resource annotation '%s' must be 'true' or 'false', got '%s'", service.Name, proxiedAnnotation, value)
+		}
+		if proxier, ok := dnsProvider.(dnsprovider.ProxyProvider); !ok || !proxier.CanProxy(recordType) {
+			return nil, fmt.Errorf("%s: provider %s cannot proxy %s records", service.Name, dnsProvider.GetName(), recordType)
+		}
+		proxied = &enabled
+	}
+	srvRecords, manageSRV, err := getSRVRecords(service, fqdn, setIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	// the SRV records of each service would replace the ones of the others
+	if merge && manageSRV {
+		return nil, fmt.Errorf("%s: service resource annotations '%s' and '%s' cannot be combined", service.Name, mergeAnnotation, srvAnnotation)
+	}
 
 	mngr := DNSController{
-		ServiceName: service.Name,
-		Provider:    dnsProvider,
+		Service:      service,
+		ServiceName:  service.Name,
+		ProviderName: providerStr,
+		Zone:         rootDomain,
+		Provider:     dnsProvider,
 		DNSRecord: &dnsprovider.DnsRecord{
 			Fqdn:    fqdn,
 			Records: records,
-			Type:    "A", // always default to "A" for now,
-			TTL:     0,   // set it to 0 and let the provider default to minimum
+			Type:    recordType,
+			TTL:     cfg.Defaults.TTL, // 0 lets the provider default to minimum
+
+			PrivateRecords: privateRecords,
+			SetIdentifier:  setIdentifier,
+			Routing:        routing,
+			HealthCheck:    healthCheck,
+			Alias:          alias,
+			Proxied:        proxied,
 		},
+		SRVRecords: srvRecords,
+		ManageSRV:  manageSRV,
+	}
+	if merge {
+		mergeRecords(service, c, &mngr)
 	}
 
 	return &mngr, nil
 }
 
+// getIngress returns the load balancer IPs of the record type and the load
+// balancer hostnames of the service
+func getIngress(service *v1.Service, recordType string) (records, hostnames []string) {
+	// 	TODO use real LB IPs
+	// if len(service.Spec.ClusterIP) > 0 {
+	// 	records = append(records, service.Spec.ClusterIP)
+	// }
+	for _, r := range service.Status.LoadBalancer.Ingress {
+		if len(r.IP) > 0 && ipMatchesType(r.IP, recordType) {
+			records = append(records, r.IP)
+		}
+		if len(r.Hostname) > 0 {
+			hostnames = append(hostnames, r.Hostname)
+		}
+	}
+	return records, hostnames
+}
+
+// getPrivateRecords returns the records of private zones, none when they get
+// the same records as public zones
+func getPrivateRecords(service *v1.Service, recordType string) ([]string, error) {
+	switch target := service.Annotations[privateTargetAnnotation]; target {
+	case "", "load-balancer":
+	case "cluster-ip":
+		if ipMatchesType(service.Spec.ClusterIP, recordType) {
+			return []string{service.Spec.ClusterIP}, nil
+		}
+		logrus.Warnf("%s: service does not have a valid cluster IP, private zones will get the load balancer IPs", service.Name)
+	default:
+		return nil, fmt.Errorf("%s: service resource annotation '%s' must be 'load-balancer' or 'cluster-ip', got '%s'", service.Name, privateTargetAnnotation, target)
+	}
+	return nil, nil
+}
+
+// getFqdn returns the validated name of the record of the service in the root
+// domain
+func getFqdn(service *v1.Service, rootDomain string) (string, error) {
+	annotations := service.Annotations
+	subDomain := fmt.Sprintf("%s.%s", service.Name, service.Namespace)
+	// allow to overwire default subDomain
+	if subDomainStr := annotations[subDomainAnnotation]; len(subDomainStr) > 0 {
+		subDomain = subDomainStr
+	}
+
+	fqdn := fmt.Sprintf("%s.%s", subDomain, rootDomain)
+	if subDomain == "@" {
+		fqdn = rootDomain
+	}
+	if hostname, ok := annotations[hostnameAnnotation]; ok {
+		fqdn = hostname
+	}
+	return normalizeHostname(service, fqdn)
+}
+
 // DNSController handles creating, updating and deleting DNS records
 type DNSController struct {
+	Service     *v1.Service
 	ServiceName string
-	Provider    dnsprovider.Provider
-	DNSRecord   *dnsprovider.DnsRecord
+	// name of the provider account in the provider annotation
+	ProviderName string
+	// root domain of the zone the records are in
+	Zone      string
+	Provider  dnsprovider.Provider
+	DNSRecord *dnsprovider.DnsRecord
+	// SRV records of the named ports, the ones pointing at DNSRecord are only
+	// created or removed when ManageSRV is set
+	SRVRecords []dnsprovider.DnsRecord
+	ManageSRV  bool
+	// DNSRecord without the values of the service when other services are
+	// merged into it, the record is updated to it instead of being deleted
+	Remaining *dnsprovider.DnsRecord
+	// why the records are synced, for the audit log
+	reason string
 }
 
-func (mngr *DNSController) GetRecord() (*dnsprovider.DnsRecord, error) {
-	fqdn := mngr.DNSRecord.Fqdn
-	return mngr.Provider.GetRecord(fqdn)
+func (mngr *DNSController) GetRecord(ctx context.Context) (*dnsprovider.DnsRecord, error) {
+	return dnsprovider.GetRecordSet(ctx, mngr.Provider, *mngr.DNSRecord)
 }
 
-func (mngr *DNSController) InsertRecord() error {
-	return mngr.Provider.AddRecord(*mngr.DNSRecord)
+func (mngr *DNSController) InsertRecord(ctx context.Context) error {
+	return mngr.apply(ctx, dnsprovider.Changes{Create: []dnsprovider.DnsRecord{*mngr.DNSRecord}})
 }
 
-func (mngr *DNSController) UpdateRecord() error {
-	return mngr.Provider.UpdateRecord(*mngr.DNSRecord)
+// UpdateRecord replaces the found record by DNSRecord
+func (mngr *DNSController) UpdateRecord(ctx context.Context, found dnsprovider.DnsRecord) error {
+	return mngr.apply(ctx, dnsprovider.Changes{Update: []dnsprovider.DnsRecord{*mngr.DNSRecord}}, found)
 }
 
-func (mngr *DNSController) DeleteRecord() error {
-	return mngr.Provider.RemoveRecord(*mngr.DNSRecord)
+// DeleteRecord deletes the found record of DNSRecord
+func (mngr *DNSController) DeleteRecord(ctx context.Context, found dnsprovider.DnsRecord) error {
+	return mngr.apply(ctx, dnsprovider.Changes{Delete: []dnsprovider.DnsRecord{*mngr.DNSRecord}}, found)
 }
 
-func slicesSimilar(x, y []string) bool {
-	if len(x) != len(y) {
-		return false
-	}
-	diff := make(map[string]int, len(x))
-	for _, _x := range x {
-		diff[_x]++
+// recordsMatch returns true if the found record already holds the desired values
+func recordsMatch(provider dnsprovider.Provider, found, desired dnsprovider.DnsRecord) bool {
+	desired = dnsprovider.Normalize(provider, desired)
+	return dnsprovider.SlicesSimilar(found.Records, desired.Records) &&
+		dnsprovider.SlicesSimilar(found.PrivateRecords, desired.PrivateRecords) &&
+		found.Routing == desired.Routing &&
+		found.HealthCheck == desired.HealthCheck &&
+		found.Alias == desired.Alias &&
+		(desired.Proxied == nil || found.Proxied != nil && *found.Proxied == *desired.Proxied) &&
+		ttlMatches(found, desired)
+}
+
+// ttlMatches compares the TTL of the records once normalized by the provider,
+// proxied records are served with a TTL chosen by the provider
+func ttlMatches(found, desired dnsprovider.DnsRecord) bool {
+	if found.Proxied != nil && *found.Proxied {
+		return true
 	}
-	for _, _y := range y {
-		if _, ok := diff[_y]; !ok {
-			return false
-		}
-		diff[_y]--
-		if diff[_y] == 0 {
-			delete(diff, _y)
-		}
+	return found.TTL == desired.TTL
+}
+
+// ipMatchesType returns true if the IP address family fits the record type
+func ipMatchesType(ip, recordType string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
 	}
-	if len(diff) == 0 {
-		return true
+	if recordType == "AAAA" {
+		return parsed.To4() == nil
 	}
-	return false
+	return parsed.To4() != nil
 }
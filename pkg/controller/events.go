@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+
+	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// reasons of the events recorded on services
+const (
+	reasonInvalidHostname  = "InvalidHostname"
+	reasonHostnameConflict = "HostnameConflict"
+)
+
+var recorder record.EventRecorder
+
+// SetEventRecorder sets the recorder of the events about services, without
+// one the errors are only returned
+func SetEventRecorder(r record.EventRecorder) {
+	recorder = r
+}
+
+// invalidHostnameError is returned for a name built from the annotations of
+// a service that cannot be published
+type invalidHostnameError struct {
+	err error
+}
+
+func (e *invalidHostnameError) Error() string {
+	return e.err.Error()
+}
+
+// normalizeHostname validates the name built from the annotations of the
+// service
+func normalizeHostname(service *v1.Service, name string) (string, error) {
+	normalized, err := dnsprovider.NormalizeHostname(name)
+	if err != nil {
+		return "", &invalidHostnameError{fmt.Errorf("%s: %v", service.Name, err)}
+	}
+	return normalized, nil
+}
+
+// recordError records the errors the owner of the service has to fix as
+// events on the service, other errors are only returned
+func recordError(service *v1.Service, err error) {
+	if recorder == nil {
+		return
+	}
+	switch err.(type) {
+	case *invalidHostnameError:
+		recorder.Event(service, v1.EventTypeWarning, reasonInvalidHostname, err.Error())
+	case *ConflictError:
+		recorder.Event(service, v1.EventTypeWarning, reasonHostnameConflict, err.Error())
+	}
+}
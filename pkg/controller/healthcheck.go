@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+var healthCheckAnnotation = "external.dns.koshk.in/health-check"                    //optional: http, https or tcp
+var healthCheckPathAnnotation = "external.dns.koshk.in/health-check-path"           //optional: /
+var healthCheckPortAnnotation = "external.dns.koshk.in/health-check-port"           //optional: first service port
+var healthCheckIntervalAnnotation = "external.dns.koshk.in/health-check-interval"   //optional: 10 or 30 seconds
+var healthCheckThresholdAnnotation = "external.dns.koshk.in/health-check-threshold" //optional: 1-10 checks
+
+// getHealthCheck parses the health check annotations of the service, the
+// provider has to support the protocol
+func getHealthCheck(service *v1.Service, provider dnsprovider.Provider) (dnsprovider.HealthCheck, error) {
+	annotations := service.Annotations
+	check := dnsprovider.HealthCheck{
+		Protocol:         strings.ToUpper(annotations[healthCheckAnnotation]),
+		Path:             "/",
+		Interval:         30,
+		FailureThreshold: 3,
+	}
+	if len(check.Protocol) == 0 {
+		for _, annotation := range []string{healthCheckPathAnnotation, healthCheckPortAnnotation, healthCheckIntervalAnnotation, healthCheckThresholdAnnotation} {
+			if _, ok := annotations[annotation]; ok {
+				return dnsprovider.HealthCheck{}, fmt.Errorf("%s: service resource annotation '%s' requires '%s'", service.Name, annotation, healthCheckAnnotation)
+			}
+		}
+		return dnsprovider.HealthCheck{}, nil
+	}
+
+	checker, ok := provider.(dnsprovider.HealthCheckProvider)
+	if !ok {
+		return check, fmt.Errorf("%s: provider %s does not support health checks", service.Name, provider.GetName())
+	}
+	protocols := checker.HealthCheckProtocols()
+	if !contains(protocols, check.Protocol) {
+		return check, fmt.Errorf("%s: service resource annotation '%s' must be one of %s, got '%s'", service.Name, healthCheckAnnotation, strings.Join(protocols, ", "), annotations[healthCheckAnnotation])
+	}
+
+	if path, ok := annotations[healthCheckPathAnnotation]; ok {
+		if check.Protocol == "TCP" || !strings.HasPrefix(path, "/") {
+			return check, fmt.Errorf("%s: service resource annotation '%s' must start with '/' and is only used with HTTP and HTTPS", service.Name, healthCheckPathAnnotation)
+		}
+		check.Path = path
+	}
+	if check.Protocol == "TCP" {
+		check.Path = ""
+	}
+
+	if len(service.Spec.Ports) > 0 {
+		check.Port = int(service.Spec.Ports[0].Port)
+	}
+	if value, ok := annotations[healthCheckPortAnnotation]; ok {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return check, fmt.Errorf("%s: service resource annotation '%s' must be a port number, got '%s'", service.Name, healthCheckPortAnnotation, value)
+		}
+		check.Port = port
+	}
+	if check.Port == 0 {
+		return check, fmt.Errorf("%s: service has no ports, set the annotation '%s'", service.Name, healthCheckPortAnnotation)
+	}
+
+	if value, ok := annotations[healthCheckIntervalAnnotation]; ok {
+		interval, err := strconv.Atoi(value)
+		if err != nil || (interval != 10 && interval != 30) {
+			return check, fmt.Errorf("%s: service resource annotation '%s' must be 10 or 30, got '%s'", service.Name, healthCheckIntervalAnnotation, value)
+		}
+		check.Interval = interval
+	}
+	if value, ok := annotations[healthCheckThresholdAnnotation]; ok {
+		threshold, err := strconv.Atoi(value)
+		if err != nil || threshold < 1 || threshold > 10 {
+			return check, fmt.Errorf("%s: service resource annotation '%s' must be a number between 1 and 10, got '%s'", service.Name, healthCheckThresholdAnnotation, value)
+		}
+		check.FailureThreshold = threshold
+	}
+	return check, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var mergeAnnotation = "external.dns.koshk.in/merge" //optional: true shares the name with the other services setting it, the record gets the IPs of all of them
+
+// getMerge returns true if the service shares its name with other services
+func getMerge(service *v1.Service) (bool, error) {
+	value, ok := service.Annotations[mergeAnnotation]
+	if !ok {
+		return false, nil
+	}
+	merge, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s: service resource annotation '%s' must be 'true' or 'false', got '%s'", service.Name, mergeAnnotation, value)
+	}
+	return merge, nil
+}
+
+// mergeRecords adds the IPs of the other services merging the claimed name to
+// the record of the manager, the record without the IPs of the service is kept
+// for when it is removed
+func mergeRecords(service *v1.Service, c claim, mngr *DNSController) {
+	record := mngr.DNSRecord
+	var others []*v1.Service
+	for _, other := range claimantsOf(service, c) {
+		if merge, _ := getMerge(other); merge {
+			others = append(others, other)
+		}
+	}
+	if len(others) == 0 {
+		return
+	}
+
+	// private zones get the load balancer IPs of the services without a
+	// private target
+	hasPrivate := len(record.PrivateRecords) > 0
+	var records, privateRecords [][]string
+	for _, other := range others {
+		ips, _ := getIngress(other, record.Type)
+		private, err := getPrivateRecords(other, record.Type)
+		if err != nil {
+			continue
+		}
+		hasPrivate = hasPrivate || len(private) > 0
+		if len(private) == 0 {
+			private = ips
+		}
+		records = append(records, ips)
+		privateRecords = append(privateRecords, private)
+	}
+
+	remaining := *record
+	remaining.Records = union(records...)
+	remaining.PrivateRecords = nil
+	if hasPrivate {
+		remaining.PrivateRecords = union(privateRecords...)
+	}
+	if len(remaining.Records) > 0 {
+		mngr.Remaining = &remaining
+	}
+
+	private := record.PrivateRecords
+	if len(private) == 0 {
+		private = record.Records
+	}
+	record.Records = union(append(records, record.Records)...)
+	if hasPrivate {
+		record.PrivateRecords = union(append(privateRecords, private)...)
+	}
+}
+
+// union returns the values of all the lists once, sorted so every service
+// merging the name writes the same record
+func union(lists ...[]string) []string {
+	seen := map[string]bool{}
+	var values []string
+	for _, list := range lists {
+		for _, value := range list {
+			if !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+		}
+	}
+	sort.Strings(values)
+	return values
+}
@@ -0,0 +1,92 @@
+package dns
+
+import (
+	"sync"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/audit"
+	"github.com/dkoshkin/kube-external-dns/pkg/notify"
+)
+
+var notifier *notify.Notifier
+
+// SetNotifier sets the notifier of the record changes and sync failures
+func SetNotifier(n *notify.Notifier) {
+	notifier = n
+}
+
+// failed syncs in a row, keyed by service and provider
+var failures = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: map[string]int{}}
+
+// notifyChanges notifies the changes the provider accepted
+func notifyChanges(entries []audit.Entry) {
+	if notifier == nil {
+		return
+	}
+	for _, e := range entries {
+		if len(e.Error) > 0 {
+			continue
+		}
+		notifier.Notify(notify.Event{
+			Type:       notify.EventChange,
+			Time:       e.Time,
+			Provider:   e.Provider,
+			Zone:       e.Zone,
+			FQDN:       e.FQDN,
+			Object:     notify.Object{Kind: e.Object.Kind, Namespace: e.Object.Namespace, Name: e.Object.Name},
+			Action:     e.Action,
+			RecordType: e.Type,
+			OldValues:  e.OldValues,
+			NewValues:  e.NewValues,
+		})
+	}
+}
+
+// trackResult counts the failed syncs of the service with the provider, the
+// failure is notified once it happened FailureThreshold times in a row and
+// the recovery when a sync succeeds again. A conflict is neither, it lasts
+// until the other service releases the name.
+func trackResult(service *v1.Service, result ProviderResult) {
+	if notifier == nil {
+		return
+	}
+	if _, ok := result.Err.(*ConflictError); ok {
+		return
+	}
+	key := service.Namespace + "/" + service.Name + "/" + result.Provider
+	event := notify.Event{
+		Provider: result.Provider,
+		Zone:     result.Zone,
+		Object:   notify.Object{Kind: "Service", Namespace: service.Namespace, Name: service.Name},
+	}
+	if result.Record != nil {
+		event.FQDN = result.Record.Fqdn
+	}
+
+	failures.Lock()
+	defer failures.Unlock()
+	count := failures.counts[key]
+	threshold := cfg.Notifications.FailureThreshold
+	if result.Err == nil {
+		delete(failures.counts, key)
+		if count >= threshold {
+			event.Type = notify.EventRecovery
+			event.Failures = count
+			notifier.Notify(event)
+		}
+		return
+	}
+
+	count++
+	failures.counts[key] = count
+	if count == threshold {
+		event.Type = notify.EventFailure
+		event.Error = result.Err.Error()
+		event.Failures = count
+		notifier.Notify(event)
+	}
+}
@@ -0,0 +1,176 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"k8s.io/client-go/pkg/api/v1"
+
+	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// ReconcileResult is the outcome of reconciling a single service with one of
+// its providers
+type ReconcileResult struct {
+	Service *v1.Service
+	ProviderResult
+}
+
+// zoneService is a service published to the zone being reconciled
+type zoneService struct {
+	service *v1.Service
+	target  Target
+}
+
+// zoneChanges are the changes made to the zone for a service
+type zoneChanges struct {
+	zoneService
+	changes dnsprovider.Changes
+}
+
+// Reconcile brings the records of all the services up to date. The zone is
+// listed once per provider and root domain and all the changes for it are sent
+// with a single ApplyChanges call.
+func Reconcile(ctx context.Context, services []*v1.Service) []ReconcileResult {
+	var results []ReconcileResult
+
+	// group by provider and root domain, GetManager initializes the provider
+	// for the root domain so a group has to be handled before the next one
+	var keys []string
+	groups := map[string][]zoneService{}
+	for _, service := range services {
+		targets, err := GetTargets(ctx, service)
+		if err != nil {
+			recordError(service, err)
+			results = append(results, ReconcileResult{Service: service, ProviderResult: ProviderResult{Err: err}})
+			continue
+		}
+		for _, target := range targets {
+			key := target.key()
+			if _, exists := groups[key]; !exists {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], zoneService{service: service, target: target})
+		}
+	}
+
+	for _, key := range keys {
+		results = append(results, reconcileZone(ctx, groups[key])...)
+	}
+	for _, result := range results {
+		trackResult(result.Service, result.ProviderResult)
+	}
+	return results
+}
+
+// reconcileZone gets a single operation timeout for the whole zone
+func reconcileZone(ctx context.Context, services []zoneService) []ReconcileResult {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Controller.OperationTimeout.Duration)
+	defer cancel()
+
+	var results []ReconcileResult
+	var changed []int
+	var changes dnsprovider.Changes
+	var provider dnsprovider.Provider
+	var existing map[string]dnsprovider.DnsRecord
+	planned := map[string]bool{}
+	// changes of each service, for the audit log and notifications
+	var audited []zoneChanges
+
+	for i, zs := range services {
+		service, providerName := zs.service, zs.target.Provider
+		result := func(changed bool, record *dnsprovider.DnsRecord, err error) ReconcileResult {
+			return ReconcileResult{Service: service, ProviderResult: ProviderResult{Provider: providerName, Zone: zs.target.RootDomain, Changed: changed, Record: record, Err: err}}
+		}
+		mngr, err := GetManager(ctx, service, zs.target)
+		if err != nil || mngr == nil {
+			recordError(service, err)
+			results = append(results, result(false, nil, err))
+			continue
+		}
+		if provider == nil {
+			provider = mngr.Provider
+			if existing, err = listRecords(ctx, provider); err != nil {
+				err = fmt.Errorf("%s: could not list records of %s: %v", service.Name, providerName, err)
+				// nothing can be compared without the zone records
+				for _, s := range services[i:] {
+					results = append(results, ReconcileResult{Service: s.service, ProviderResult: ProviderResult{Provider: providerName, Zone: s.target.RootDomain, Err: err}})
+				}
+				return results
+			}
+		}
+
+		record := *mngr.DNSRecord
+		key := recordKey(record)
+		// merged records are the same for all the services sharing them
+		if planned[key] {
+			logrus.Infof("%s: is merged into a record already being changed", mngr.ServiceName)
+			changed = append(changed, len(results))
+			results = append(results, result(true, mngr.DNSRecord, nil))
+			continue
+		}
+		found, ok := existing[key]
+		var serviceChanges dnsprovider.Changes
+		switch {
+		case !ok:
+			logrus.Infof("%s: is not already set, will be creating a new record", mngr.ServiceName)
+			serviceChanges.Create = append(serviceChanges.Create, record)
+		case !recordsMatch(provider, found, record):
+			logrus.Warnf("%s: is set but contains different records, will be updating it", mngr.ServiceName)
+			serviceChanges.Update = append(serviceChanges.Update, record)
+		}
+		if mngr.ManageSRV {
+			serviceChanges.Add(srvChanges(provider, record.Fqdn, mngr.SRVRecords, zoneRecords(existing)))
+		}
+		if serviceChanges.Empty() {
+			results = append(results, result(false, mngr.DNSRecord, nil))
+			continue
+		}
+		planned[key] = true
+		changes.Add(serviceChanges)
+		audited = append(audited, zoneChanges{zoneService: zs, changes: serviceChanges})
+		changed = append(changed, len(results))
+		results = append(results, result(true, mngr.DNSRecord, nil))
+	}
+
+	if provider == nil || changes.Empty() {
+		return results
+	}
+	err := dnsprovider.ApplyChanges(ctx, provider, changes)
+	for _, a := range audited {
+		reportChanges(a.service, a.target, reasonResync, a.changes, zoneRecords(existing), err)
+	}
+	if err != nil {
+		for _, i := range changed {
+			results[i].Changed = false
+			results[i].Err = fmt.Errorf("%s: could not apply changes: %v", results[i].Service.Name, err)
+		}
+	}
+	return results
+}
+
+func listRecords(ctx context.Context, provider dnsprovider.Provider) (map[string]dnsprovider.DnsRecord, error) {
+	records, err := provider.GetRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]dnsprovider.DnsRecord, len(records))
+	for _, r := range records {
+		existing[recordKey(r)] = r
+	}
+	return existing, nil
+}
+
+func zoneRecords(existing map[string]dnsprovider.DnsRecord) []dnsprovider.DnsRecord {
+	records := make([]dnsprovider.DnsRecord, 0, len(existing))
+	for _, r := range existing {
+		records = append(records, r)
+	}
+	return records
+}
+
+func recordKey(record dnsprovider.DnsRecord) string {
+	return strings.ToLower(dnsprovider.Fqdn(record.Fqdn)) + "/" + record.Type + "/" + record.SetIdentifier
+}
@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+var setIdentifierAnnotation = "external.dns.koshk.in/set-identifier" //required with a routing policy
+var weightAnnotation = "external.dns.koshk.in/weight"                //optional: 0-255
+var regionAnnotation = "external.dns.koshk.in/region"                //optional: us-east-1, latency based routing
+var geolocationAnnotation = "external.dns.koshk.in/geolocation"      //optional: continent=EU, country=US,subdivision=CA or country=*
+var failoverAnnotation = "external.dns.koshk.in/failover"            //optional: primary or secondary
+var multiValueAnnotation = "external.dns.koshk.in/multivalue"        //optional: true
+
+// getRoutingPolicy parses the routing annotations of the service, at most one
+// policy can be set and it requires a set identifier
+func getRoutingPolicy(service *v1.Service) (string, dnsprovider.RoutingPolicy, error) {
+	annotations := service.Annotations
+	var policy dnsprovider.RoutingPolicy
+	var policies []string
+	set := func(annotation, policyType string) (string, bool) {
+		value, ok := annotations[annotation]
+		if ok {
+			policy.Type = policyType
+			policies = append(policies, annotation)
+		}
+		return value, ok
+	}
+
+	if value, ok := set(weightAnnotation, dnsprovider.RoutingWeighted); ok {
+		weight, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || weight < 0 || weight > 255 {
+			return "", policy, fmt.Errorf("%s: service resource annotation '%s' must be a number between 0 and 255, got '%s'", service.Name, weightAnnotation, value)
+		}
+		policy.Weight = weight
+	}
+	if value, ok := set(regionAnnotation, dnsprovider.RoutingLatency); ok {
+		if len(value) == 0 {
+			return "", policy, fmt.Errorf("%s: service resource annotation '%s' cannot be empty", service.Name, regionAnnotation)
+		}
+		policy.Region = value
+	}
+	if value, ok := set(geolocationAnnotation, dnsprovider.RoutingGeolocation); ok {
+		if err := parseGeolocation(value, &policy); err != nil {
+			return "", policy, fmt.Errorf("%s: service resource annotation '%s' is invalid: %v", service.Name, geolocationAnnotation, err)
+		}
+	}
+	if value, ok := set(failoverAnnotation, dnsprovider.RoutingFailover); ok {
+		switch strings.ToLower(value) {
+		case "primary", "secondary":
+			policy.Failover = strings.ToUpper(value)
+		default:
+			return "", policy, fmt.Errorf("%s: service resource annotation '%s' must be 'primary' or 'secondary', got '%s'", service.Name, failoverAnnotation, value)
+		}
+	}
+	if value, ok := set(multiValueAnnotation, dnsprovider.RoutingMultiValue); ok {
+		if enabled, err := strconv.ParseBool(value); err != nil || !enabled {
+			return "", policy, fmt.Errorf("%s: service resource annotation '%s' can only be 'true', got '%s'", service.Name, multiValueAnnotation, value)
+		}
+	}
+
+	setIdentifier := annotations[setIdentifierAnnotation]
+	switch {
+	case len(policies) > 1:
+		return "", policy, fmt.Errorf("%s: service resource annotations %s cannot be combined", service.Name, strings.Join(policies, ", "))
+	case len(policies) == 1 && len(setIdentifier) == 0:
+		return "", policy, fmt.Errorf("%s: service resource annotation '%s' is required with '%s'", service.Name, setIdentifierAnnotation, policies[0])
+	case len(policies) == 0 && len(setIdentifier) > 0:
+		return "", policy, fmt.Errorf("%s: service resource annotation '%s' requires a routing policy annotation", service.Name, setIdentifierAnnotation)
+	}
+	return setIdentifier, policy, nil
+}
+
+// parseGeolocation reads a comma separated list of continent, country and
+// subdivision codes
+func parseGeolocation(value string, policy *dnsprovider.RoutingPolicy) error {
+	for _, field := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) != 2 || len(parts[1]) == 0 {
+			return fmt.Errorf("expected key=value, got '%s'", field)
+		}
+		switch code := strings.ToUpper(strings.TrimSpace(parts[1])); strings.TrimSpace(parts[0]) {
+		case "continent":
+			policy.Continent = code
+		case "country":
+			policy.Country = code
+		case "subdivision":
+			policy.Subdivision = code
+		default:
+			return fmt.Errorf("unknown key '%s', expected continent, country or subdivision", parts[0])
+		}
+	}
+	if len(policy.Continent) > 0 && len(policy.Country) > 0 {
+		return fmt.Errorf("continent and country cannot be combined")
+	}
+	if len(policy.Continent) == 0 && len(policy.Country) == 0 {
+		return fmt.Errorf("continent or country is required")
+	}
+	if len(policy.Subdivision) > 0 && policy.Country != "US" {
+		return fmt.Errorf("subdivision is only supported with country=US")
+	}
+	return nil
+}
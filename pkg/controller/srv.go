@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"k8s.io/client-go/pkg/api/v1"
+
+	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+var srvAnnotation = "external.dns.koshk.in/srv" //optional: true publishes SRV records for the named ports, false removes them
+
+// getSRVRecords parses the SRV annotation of the service, it returns false if
+// the SRV records of the service are not managed. Every named port gets a
+// _name._protocol record pointing at the fqdn.
+func getSRVRecords(service *v1.Service, fqdn, setIdentifier string) ([]dnsprovider.DnsRecord, bool, error) {
+	value, ok := service.Annotations[srvAnnotation]
+	if !ok {
+		return nil, false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: service resource annotation '%s' must be 'true' or 'false', got '%s'", service.Name, srvAnnotation, value)
+	}
+	if !enabled {
+		return nil, true, nil
+	}
+	// the records of every cluster would have the same names
+	if len(setIdentifier) > 0 {
+		return nil, false, fmt.Errorf("%s: service resource annotation '%s' cannot be combined with a routing policy", service.Name, srvAnnotation)
+	}
+
+	var records []dnsprovider.DnsRecord
+	for _, port := range service.Spec.Ports {
+		if len(port.Name) == 0 {
+			continue
+		}
+		protocol := port.Protocol
+		if len(protocol) == 0 {
+			protocol = v1.ProtocolTCP
+		}
+		name := fmt.Sprintf("_%s._%s.%s", port.Name, strings.ToLower(string(protocol)), fqdn)
+		records = append(records, dnsprovider.NewRecord(name, dnsprovider.TypeSRV, cfg.Defaults.TTL, dnsprovider.RecordData{
+			Port:   int(port.Port),
+			Target: fqdn,
+		}))
+	}
+	return records, true, nil
+}
+
+// srvChanges returns the changes that bring the SRV records of the fqdn in the
+// zone records up to date. Only the SRV records pointing at the fqdn are
+// removed, others may have been created by hand.
+func srvChanges(provider dnsprovider.Provider, fqdn string, desired, records []dnsprovider.DnsRecord) dnsprovider.Changes {
+	existing := map[string]dnsprovider.DnsRecord{}
+	for _, r := range records {
+		if ownedSRV(r, fqdn) {
+			existing[dnsprovider.Fqdn(r.Fqdn)] = r
+		}
+	}
+
+	var changes dnsprovider.Changes
+	for _, record := range desired {
+		found, ok := existing[record.Fqdn]
+		delete(existing, record.Fqdn)
+		switch {
+		case !ok:
+			changes.Create = append(changes.Create, record)
+		case !recordsMatch(provider, found, record):
+			changes.Update = append(changes.Update, record)
+		}
+	}
+	for _, record := range existing {
+		changes.Delete = append(changes.Delete, record)
+	}
+	return changes
+}
+
+// ownedSRV returns true for an SRV record named _service._protocol.fqdn with
+// every value pointing at the fqdn
+func ownedSRV(record dnsprovider.DnsRecord, fqdn string) bool {
+	fqdn = dnsprovider.Fqdn(strings.ToLower(fqdn))
+	labels := strings.SplitN(strings.ToLower(dnsprovider.Fqdn(record.Fqdn)), ".", 3)
+	if record.Type != dnsprovider.TypeSRV || len(labels) != 3 || labels[2] != fqdn ||
+		!strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return false
+	}
+	data, err := record.Data()
+	if err != nil || len(data) == 0 {
+		return false
+	}
+	for _, d := range data {
+		if d.Target != fqdn {
+			return false
+		}
+	}
+	return true
+}
+
+// syncSRVRecords creates, updates and removes the SRV records of the service,
+// it returns true if the zone was changed
+func (mngr *DNSController) syncSRVRecords(ctx context.Context) (bool, error) {
+	if !mngr.ManageSRV {
+		return false, nil
+	}
+	records, err := mngr.Provider.GetRecords(ctx)
+	if err != nil {
+		return false, fmt.Errorf("%s: could not list SRV records of '%s': %v", mngr.ServiceName, mngr.DNSRecord.Fqdn, err)
+	}
+	changes := srvChanges(mngr.Provider, mngr.DNSRecord.Fqdn, mngr.SRVRecords, records)
+	if changes.Empty() {
+		return false, nil
+	}
+	if err := mngr.apply(ctx, changes, records...); err != nil {
+		return false, fmt.Errorf("%s: could not update SRV records of '%s': %v", mngr.ServiceName, mngr.DNSRecord.Fqdn, err)
+	}
+	return true, nil
+}
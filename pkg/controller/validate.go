@@ -0,0 +1,64 @@
+package dns
+
+import (
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// addresses reserved for documentation, they stand in for the load balancer
+// of a service that does not have one yet
+const (
+	placeholderIPv4 = "192.0.2.1"
+	placeholderIPv6 = "2001:db8::1"
+)
+
+// ValidateService runs the checks of GetManager for every target of the
+// service, including the names already published for other services, without
+// changing any record. The admission webhook uses it to reject a service
+// before it is created, so nothing is sent to the providers: the zones are the
+// configured or last listed ones and the provider is only asked what it
+// supports. A service whose zone is not known yet is left to the controller.
+func ValidateService(ctx context.Context, service *v1.Service) error {
+	service = withPlaceholders(service)
+	targets, err := getTargets(ctx, service, discovery.cachedZonesOf)
+	if err == errZonesNotListed {
+		logrus.Debugf("%s: zones are not listed yet, the service is not validated", service.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if _, err := newManager(ctx, service, target, capabilities); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capabilities returns an uninitialized instance of the provider
+func capabilities(ctx context.Context, name, rootDomainName string) (dnsprovider.Provider, error) {
+	return dnsprovider.Capabilities(name)
+}
+
+// withPlaceholders returns a copy of the service with a load balancer IP, a
+// service is created before its load balancer and GetManager skips it without
+// one. A service being created is newer than the services it conflicts with.
+func withPlaceholders(service *v1.Service) *v1.Service {
+	s := *service
+	if len(s.Status.LoadBalancer.Ingress) == 0 {
+		ip := placeholderIPv4
+		if cfg.Defaults.RecordType == "AAAA" {
+			ip = placeholderIPv6
+		}
+		s.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: ip}}
+	}
+	if s.CreationTimestamp.IsZero() {
+		s.CreationTimestamp = metav1.Now()
+	}
+	return &s
+}
@@ -0,0 +1,253 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"k8s.io/client-go/pkg/api/v1"
+
+	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+var hostnameAnnotation = "external.dns.koshk.in/hostname" //optional: full name, replaces root-domain and sub-domain
+
+// zoneDiscovery caches the zones visible to each provider account
+type zoneDiscovery struct {
+	mutex   sync.Mutex
+	zones   map[string][]string
+	fetched map[string]time.Time
+	// listings in progress, the lookups of an account wait for its listing
+	// while the other accounts are not held up
+	listings map[string]*zoneListing
+}
+
+type zoneListing struct {
+	done  chan struct{}
+	zones []string
+	err   error
+}
+
+var discovery = &zoneDiscovery{
+	zones:    map[string][]string{},
+	fetched:  map[string]time.Time{},
+	listings: map[string]*zoneListing{},
+}
+
+// zonesOf returns the zones of the provider account. The zones of the
+// configuration are used as they are, otherwise the account lists its zones
+// again every ZoneRefreshPeriod.
+func (d *zoneDiscovery) zonesOf(ctx context.Context, name string) ([]string, error) {
+	if providerCfg, ok := cfg.Provider(name); ok && len(providerCfg.Zones) > 0 {
+		zones := make([]string, len(providerCfg.Zones))
+		for i, zone := range providerCfg.Zones {
+			zones[i] = zone.Name
+		}
+		return zones, nil
+	}
+
+	d.mutex.Lock()
+	if fetched, ok := d.fetched[name]; ok && time.Since(fetched) < cfg.Controller.ZoneRefreshPeriod.Duration {
+		zones := d.zones[name]
+		d.mutex.Unlock()
+		return zones, nil
+	}
+	if listing, ok := d.listings[name]; ok {
+		d.mutex.Unlock()
+		select {
+		case <-listing.done:
+			return listing.zones, listing.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	listing := &zoneListing{done: make(chan struct{})}
+	d.listings[name] = listing
+	d.mutex.Unlock()
+
+	// the lock is not held while the account is listed
+	zones, err := dnsprovider.ListZones(ctx, name)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.listings, name)
+	defer close(listing.done)
+	if err != nil {
+		if cached, ok := d.zones[name]; ok {
+			logrus.Warnf("%s: could not refresh zones, using the last known ones: %v", name, err)
+			listing.zones = cached
+			return cached, nil
+		}
+		listing.err = err
+		return nil, err
+	}
+	logrus.Debugf("%s: discovered %d zones", name, len(zones))
+	d.zones[name] = zones
+	d.fetched[name] = time.Now()
+	listing.zones = zones
+	return zones, nil
+}
+
+// errZonesNotListed is returned by cachedZonesOf for an account whose zones
+// were not listed yet
+var errZonesNotListed = errors.New("zones are not listed yet")
+
+// cachedZonesOf returns the zones of the configuration or the last listed
+// zones of the provider account, the account is never asked for them
+func (d *zoneDiscovery) cachedZonesOf(ctx context.Context, name string) ([]string, error) {
+	if providerCfg, ok := cfg.Provider(name); ok && len(providerCfg.Zones) > 0 {
+		return d.zonesOf(ctx, name)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	zones, ok := d.zones[name]
+	if !ok {
+		return nil, errZonesNotListed
+	}
+	return zones, nil
+}
+
+// findZone returns the provider account and the zone that is the longest
+// suffix of the hostname, every configured account is searched when the
+// provider is not set. The zones of an account are returned by zonesOf.
+func findZone(ctx context.Context, providerName, hostname string, zonesOf func(ctx context.Context, name string) ([]string, error)) (string, string, error) {
+	candidates := []string{providerName}
+	if len(providerName) == 0 {
+		candidates = nil
+		for _, p := range cfg.Providers {
+			candidates = append(candidates, p.Name)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", "", fmt.Errorf("no provider is configured to look up the zone of '%s'", hostname)
+	}
+
+	hostname = strings.ToLower(dnsprovider.UnFqdn(hostname))
+	var bestProvider, bestZone string
+	for _, name := range candidates {
+		zones, err := zonesOf(ctx, name)
+		if err != nil {
+			if len(candidates) == 1 || err == errZonesNotListed {
+				return "", "", err
+			}
+			logrus.Warnf("%s: could not list zones: %v", name, err)
+			continue
+		}
+		for _, zone := range zones {
+			zone = strings.ToLower(dnsprovider.UnFqdn(zone))
+			if hostname != zone && !strings.HasSuffix(hostname, "."+zone) {
+				continue
+			}
+			// accounts earlier in the configuration win ties
+			if len(zone) > len(bestZone) {
+				bestProvider, bestZone = name, zone
+			}
+		}
+	}
+	if len(bestZone) == 0 {
+		return "", "", fmt.Errorf("no zone found for '%s'", hostname)
+	}
+	return bestProvider, bestZone, nil
+}
+
+// Target is a provider account and a zone a service is published to
+type Target struct {
+	Provider   string
+	RootDomain string
+}
+
+func (t Target) key() string {
+	return t.Provider + "/" + t.RootDomain
+}
+
+// GetTargets returns the provider accounts and zones of the service, one per
+// provider in the comma separated provider annotation. The zone is the root
+// domain annotation or is looked up from the hostname annotation.
+func GetTargets(ctx context.Context, service *v1.Service) ([]Target, error) {
+	return getTargets(ctx, service, discovery.zonesOf)
+}
+
+// getTargets returns the targets of the service, looking the zones of the
+// provider accounts up with zonesOf
+func getTargets(ctx context.Context, service *v1.Service, zonesOf func(ctx context.Context, name string) ([]string, error)) ([]Target, error) {
+	if service == nil {
+		logrus.Warn("service object is nil")
+		return nil, nil
+	}
+	if !cfg.Filters.AllowsNamespace(service.Namespace) {
+		logrus.Debugf("%s: namespace '%s' is filtered out", service.Name, service.Namespace)
+		return nil, nil
+	}
+	// get details from annotations
+	annotations := service.Annotations
+	providerStr, hasProvider := annotations[providerAnnotation]
+	hostname, hasHostname := annotations[hostnameAnnotation]
+	if !hasProvider && !hasHostname {
+		logrus.Infof("%s: service resource does not have the annotation '%s'", service.Name, providerAnnotation)
+		return nil, nil
+	}
+
+	var providers []string
+	for _, name := range strings.Split(providerStr, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 && !contains(providers, name) {
+			providers = append(providers, name)
+		}
+	}
+	if hasProvider && len(providers) == 0 {
+		return nil, fmt.Errorf("%s: service resource annotation '%s' cannot be empty", service.Name, providerAnnotation)
+	}
+
+	if !hasHostname {
+		rootDomain := annotations[rootDomainAnnotation]
+		if len(rootDomain) == 0 {
+			return nil, fmt.Errorf("%s: service resource annotation '%s' cannot be empty", service.Name, rootDomainAnnotation)
+		}
+		rootDomain, err := normalizeHostname(service, rootDomain)
+		if err != nil {
+			return nil, err
+		}
+		targets := make([]Target, len(providers))
+		for i, name := range providers {
+			targets[i] = Target{Provider: name, RootDomain: rootDomain}
+		}
+		return targets, nil
+	}
+
+	for _, annotation := range []string{rootDomainAnnotation, subDomainAnnotation} {
+		if _, ok := annotations[annotation]; ok {
+			return nil, fmt.Errorf("%s: service resource annotations '%s' and '%s' cannot be combined", service.Name, hostnameAnnotation, annotation)
+		}
+	}
+	if len(hostname) == 0 {
+		return nil, fmt.Errorf("%s: service resource annotation '%s' cannot be empty", service.Name, hostnameAnnotation)
+	}
+	hostname, err := normalizeHostname(service, hostname)
+	if err != nil {
+		return nil, err
+	}
+	// without a provider the best matching account is used
+	if len(providers) == 0 {
+		providers = []string{""}
+	}
+	// the zones may have to be listed, which is bounded like the other calls
+	// to the providers
+	ctx, cancel := context.WithTimeout(ctx, cfg.Controller.OperationTimeout.Duration)
+	defer cancel()
+	var targets []Target
+	for _, name := range providers {
+		provider, zone, err := findZone(ctx, name, hostname, zonesOf)
+		if err == errZonesNotListed {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", service.Name, err)
+		}
+		targets = append(targets, Target{Provider: provider, RootDomain: zone})
+	}
+	return targets, nil
+}
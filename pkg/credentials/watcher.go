@@ -0,0 +1,126 @@
+package credentials
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/config"
+	dnsprovider "github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// Watcher keeps provider accounts configured with the contents of the secrets
+// they reference, a rotated secret re-initializes the affected providers
+type Watcher struct {
+	clientset *kubernetes.Clientset
+	providers []config.ProviderConfig
+	synced    []cache.InformerSynced
+	// bounds the provider re-initialization after a secret change
+	timeout time.Duration
+}
+
+// NewWatcher returns a watcher for the providers that reference a secret
+func NewWatcher(clientset *kubernetes.Clientset, providers []config.ProviderConfig, timeout time.Duration) *Watcher {
+	w := &Watcher{clientset: clientset, timeout: timeout}
+	for _, p := range providers {
+		if p.SecretRef != nil {
+			w.providers = append(w.providers, p)
+		}
+	}
+	return w
+}
+
+// Run starts an informer per referenced secret and blocks until the secrets
+// have been loaded once, the informers stop when the context is done
+func (w *Watcher) Run(ctx context.Context) error {
+	stopCh := ctx.Done()
+	stores := make([]cache.Store, len(w.providers))
+	for i, p := range w.providers {
+		store, controller := w.newInformer(ctx, p)
+		stores[i] = store
+		w.synced = append(w.synced, controller.HasSynced)
+		go controller.Run(stopCh)
+	}
+	if !cache.WaitForCacheSync(stopCh, w.synced...) {
+		return fmt.Errorf("could not load provider secrets")
+	}
+	for i, p := range w.providers {
+		if len(stores[i].List()) > 0 {
+			continue
+		}
+		logrus.Warnf("%s: secret %s/%s does not exist, the provider only uses its configured options until it is created", p.Name, p.SecretRef.SecretNamespace(), p.SecretRef.Name)
+		if err := Configure(ctx, p, dnsprovider.Options(p.Options)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Watcher) newInformer(ctx context.Context, p config.ProviderConfig) (cache.Store, cache.Controller) {
+	name := p.Name
+	ref := p.SecretRef
+	watchlist := cache.NewListWatchFromClient(
+		w.clientset.Core().RESTClient(),
+		"secrets",
+		ref.SecretNamespace(),
+		fields.OneTermEqualSelector("metadata.name", ref.Name))
+
+	configure := func(obj interface{}) {
+		secret := obj.(*v1.Secret)
+		options := mergeOptions(p.Options, secret.Data)
+		logrus.Infof("%s: loaded credentials from secret %s/%s", name, secret.Namespace, secret.Name)
+		ctx, cancel := context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+		if err := Configure(ctx, p, options); err != nil {
+			logrus.Errorf("%s: could not configure provider from secret %s/%s: %v", name, secret.Namespace, secret.Name, err)
+		}
+	}
+
+	store, controller := cache.NewInformer(
+		watchlist,
+		&v1.Secret{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: configure,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				// resyncs and metadata only changes should not re-initialize the provider
+				if oldObj.(*v1.Secret).ResourceVersion == newObj.(*v1.Secret).ResourceVersion {
+					return
+				}
+				configure(newObj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				logrus.Warnf("%s: secret %s/%s was deleted, keeping the last known credentials", name, ref.SecretNamespace(), ref.Name)
+			},
+		},
+	)
+	return store, controller
+}
+
+// Configure sets up the provider instance with the options and the zone
+// options of its configuration
+func Configure(ctx context.Context, p config.ProviderConfig, options dnsprovider.Options) error {
+	zoneOptions := map[string]dnsprovider.Options{}
+	for zone, opts := range p.ZoneOptions() {
+		zoneOptions[zone] = dnsprovider.Options(opts)
+	}
+	return dnsprovider.Configure(ctx, p.Name, p.ProviderType(), options, zoneOptions)
+}
+
+// mergeOptions returns the configured options with the secret keys on top
+func mergeOptions(base map[string]string, data map[string][]byte) dnsprovider.Options {
+	options := dnsprovider.Options{}
+	for key, value := range base {
+		options[key] = value
+	}
+	for key, value := range data {
+		options[key] = string(value)
+	}
+	return options
+}
@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Formatter turns an event into the body posted to a webhook
+type Formatter interface {
+	ContentType() string
+	Format(event Event) ([]byte, error)
+}
+
+var (
+	formatters = make(map[string]Formatter)
+	// formatters can be registered by other packages in init
+	formattersMutex sync.Mutex
+)
+
+// RegisterFormatter makes a formatter available to the webhooks by name
+func RegisterFormatter(name string, formatter Formatter) {
+	formattersMutex.Lock()
+	defer formattersMutex.Unlock()
+	if _, exists := formatters[name]; exists {
+		logrus.Errorf("Formatter '%s' tried to register twice", name)
+	}
+	formatters[name] = formatter
+}
+
+func getFormatter(name string) (Formatter, bool) {
+	formattersMutex.Lock()
+	defer formattersMutex.Unlock()
+	formatter, ok := formatters[name]
+	return formatter, ok
+}
+
+func init() {
+	RegisterFormatter("json", jsonFormatter{})
+	RegisterFormatter("cloudevents", cloudEventsFormatter{})
+	RegisterFormatter("slack", slackFormatter{})
+}
+
+// jsonFormatter posts the event as it is
+type jsonFormatter struct{}
+
+func (jsonFormatter) ContentType() string {
+	return "application/json"
+}
+
+func (jsonFormatter) Format(event Event) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+// cloudEventsFormatter posts the event in the structured mode of CloudEvents
+// 1.0, the event is the data
+type cloudEventsFormatter struct{}
+
+type cloudEvent struct {
+	SpecVersion     string `json:"specversion"`
+	ID              string `json:"id"`
+	Source          string `json:"source"`
+	Type            string `json:"type"`
+	Subject         string `json:"subject,omitempty"`
+	Time            string `json:"time"`
+	DataContentType string `json:"datacontenttype"`
+	Data            Event  `json:"data"`
+}
+
+func (cloudEventsFormatter) ContentType() string {
+	return "application/cloudevents+json"
+}
+
+func (cloudEventsFormatter) Format(event Event) ([]byte, error) {
+	return json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              event.ID,
+		Source:          "kube-external-dns",
+		Type:            "in.koshk.external-dns." + event.Type,
+		Subject:         event.FQDN,
+		Time:            event.Time.Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            event,
+	})
+}
+
+// slackFormatter posts a message readable in chat, Slack and Mattermost
+// incoming webhooks accept it
+type slackFormatter struct{}
+
+func (slackFormatter) ContentType() string {
+	return "application/json"
+}
+
+func (slackFormatter) Format(event Event) ([]byte, error) {
+	return json.Marshal(struct {
+		Text string `json:"text"`
+	}{event.Summary()})
+}
+
+// Summary describes the event in a sentence
+func (e Event) Summary() string {
+	service := e.Object.Namespace + "/" + e.Object.Name
+	switch e.Type {
+	case EventChange:
+		return fmt.Sprintf("%s: %sd %s record %s in %s for service %s: [%s] -> [%s]", e.Provider, e.Action, e.RecordType, e.FQDN, e.Zone, service,
+			strings.Join(e.OldValues, ", "), strings.Join(e.NewValues, ", "))
+	case EventFailure:
+		return fmt.Sprintf("%s: service %s failed to sync %d times in a row: %s", e.Provider, service, e.Failures, e.Error)
+	case EventRecovery:
+		return fmt.Sprintf("%s: service %s is synced again after %d failures", e.Provider, service, e.Failures)
+	}
+	return fmt.Sprintf("%s: %s for service %s", e.Provider, e.Type, service)
+}
@@ -0,0 +1,312 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/config"
+)
+
+// Types of the events
+const (
+	// a record was created, updated or deleted
+	EventChange = "change"
+	// a service could not be synced with a provider several times in a row
+	EventFailure = "failure"
+	// a service is synced again after a notified failure
+	EventRecovery = "recovery"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	// events waiting to be posted to a webhook, newer ones are dropped
+	queueSize = 100
+	// wait before the first retry, doubled for each following one
+	retryDelay    = time.Second
+	maxRetryDelay = time.Minute
+	// time Close waits for the queued events before dropping them
+	closeTimeout = 10 * time.Second
+)
+
+// Object is the Kubernetes object the event is about
+type Object struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// Event is a change made to a provider or a persistent failure to sync
+type Event struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Provider string    `json:"provider"`
+	Zone     string    `json:"zone,omitempty"`
+	FQDN     string    `json:"fqdn,omitempty"`
+	Object   Object    `json:"object"`
+	// changes only
+	Action     string   `json:"action,omitempty"`
+	RecordType string   `json:"recordType,omitempty"`
+	OldValues  []string `json:"oldValues,omitempty"`
+	NewValues  []string `json:"newValues,omitempty"`
+	// failures and recoveries only
+	Error    string `json:"error,omitempty"`
+	Failures int    `json:"failures,omitempty"`
+}
+
+// Notifier posts the events to the configured webhooks, each webhook has its
+// own queue so a slow endpoint does not hold the others up
+type Notifier struct {
+	webhooks []*webhook
+	wg       sync.WaitGroup
+	// guards the queues, Notify drops the events once they are closed
+	mutex  sync.RWMutex
+	closed bool
+	// closed when Close gives up, aborts the posts and their retries
+	stop chan struct{}
+}
+
+type webhook struct {
+	name      string
+	url       string
+	formatter Formatter
+	events    []string
+	zones     []string
+	headers   map[string]string
+	retries   int
+	client    *http.Client
+	queue     chan Event
+	stop      chan struct{}
+}
+
+// New returns a notifier for the webhooks, Close stops it
+func New(webhooks []config.WebhookConfig) (*Notifier, error) {
+	n := &Notifier{stop: make(chan struct{})}
+	for i, w := range webhooks {
+		name := w.Name
+		if name == "" {
+			name = fmt.Sprintf("webhook %d", i)
+		}
+		format := w.Format
+		if format == "" {
+			format = "json"
+		}
+		formatter, ok := getFormatter(format)
+		if !ok {
+			return nil, fmt.Errorf("%s: no such notification format '%s'", name, format)
+		}
+		for _, event := range w.Events {
+			switch event {
+			case EventChange, EventFailure, EventRecovery:
+			default:
+				return nil, fmt.Errorf("%s: unknown event '%s', expected '%s', '%s' or '%s'", name, event, EventChange, EventFailure, EventRecovery)
+			}
+		}
+		timeout := w.Timeout.Duration
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+		zones := make([]string, len(w.Zones))
+		for i, zone := range w.Zones {
+			zones[i] = strings.ToLower(strings.TrimSuffix(zone, "."))
+		}
+		n.webhooks = append(n.webhooks, &webhook{
+			name:      name,
+			url:       w.URL,
+			formatter: formatter,
+			events:    w.Events,
+			zones:     zones,
+			headers:   w.Headers,
+			retries:   w.MaxRetries,
+			client:    &http.Client{Timeout: timeout},
+			queue:     make(chan Event, queueSize),
+			stop:      n.stop,
+		})
+	}
+	for _, w := range n.webhooks {
+		n.wg.Add(1)
+		go func(w *webhook) {
+			defer n.wg.Done()
+			w.run()
+		}(w)
+	}
+	return n, nil
+}
+
+// Notify queues the event for the webhooks it matches, it never blocks
+func (n *Notifier) Notify(event Event) {
+	if event.ID == "" {
+		event.ID = newID()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if n.closed {
+		logrus.Debugf("notification: notifier is closed, dropping %s event of service %s/%s", event.Type, event.Object.Namespace, event.Object.Name)
+		return
+	}
+	for _, w := range n.webhooks {
+		if !w.matches(event) {
+			continue
+		}
+		select {
+		case w.queue <- event:
+		default:
+			logrus.Warnf("notification %s: queue is full, dropping %s event of service %s/%s", w.name, event.Type, event.Object.Namespace, event.Object.Name)
+		}
+	}
+}
+
+// Close posts the queued events and stops the webhooks, the events that are
+// not posted within closeTimeout are dropped
+func (n *Notifier) Close() {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return
+	}
+	n.closed = true
+	for _, w := range n.webhooks {
+		close(w.queue)
+	}
+	n.mutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(closeTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	logrus.Warnf("notification: events not posted after %s, dropping them", closeTimeout)
+	close(n.stop)
+	<-done
+}
+
+func (w *webhook) matches(event Event) bool {
+	if len(w.events) > 0 && !contains(w.events, event.Type) {
+		return false
+	}
+	if len(w.zones) == 0 {
+		return true
+	}
+	zone := strings.ToLower(strings.TrimSuffix(event.Zone, "."))
+	fqdn := strings.ToLower(strings.TrimSuffix(event.FQDN, "."))
+	for _, z := range w.zones {
+		if zone == z || fqdn == z || strings.HasSuffix(fqdn, "."+z) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *webhook) run() {
+	for event := range w.queue {
+		if w.stopped() {
+			continue
+		}
+		body, err := w.formatter.Format(event)
+		if err != nil {
+			logrus.Errorf("notification %s: could not format %s event: %v", w.name, event.Type, err)
+			continue
+		}
+		delay := retryDelay
+		for attempt := 0; ; attempt++ {
+			retry, err := w.post(body)
+			if err == nil {
+				break
+			}
+			if !retry || attempt >= w.retries {
+				logrus.Errorf("notification %s: could not post %s event: %v", w.name, event.Type, err)
+				break
+			}
+			logrus.Warnf("notification %s: could not post %s event, retrying in %s: %v", w.name, event.Type, delay, err)
+			if !w.wait(delay) {
+				break
+			}
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+	}
+}
+
+// stopped returns true once the notifier gave up on the queued events
+func (w *webhook) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait sleeps for the delay, it returns false if the notifier is stopped
+// before
+func (w *webhook) wait(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.stop:
+		return false
+	}
+}
+
+// post sends the body once, it returns true if a failure may be retried
+func (w *webhook) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Cancel = w.stop
+	req.Header.Set("Content-Type", w.formatter.ContentType())
+	for key, value := range w.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("%s returned %s", w.url, resp.Status)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
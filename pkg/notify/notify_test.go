@@ -0,0 +1,35 @@
+package notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/config"
+)
+
+func TestNotifyAfterClose(t *testing.T) {
+	var posted int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posted, 1)
+	}))
+	defer server.Close()
+
+	n, err := New([]config.WebhookConfig{{URL: server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(Event{Type: EventChange})
+	n.Close()
+	if count := atomic.LoadInt32(&posted); count != 1 {
+		t.Errorf("got %d posts before closing, want 1", count)
+	}
+
+	// services still being synced on shutdown notify after Close
+	n.Notify(Event{Type: EventChange})
+	n.Close()
+	if count := atomic.LoadInt32(&posted); count != 1 {
+		t.Errorf("got %d posts after closing, want 1", count)
+	}
+}
@@ -0,0 +1,93 @@
+package dns
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ZoneCacheTTL is how long the records of a zone are reused before the zone
+// is listed again
+var ZoneCacheTTL = time.Minute
+
+// ZoneCache keeps the records of the zones a provider manages so lookups do
+// not list the whole zone every time. Providers must invalidate a zone after
+// writing to it.
+type ZoneCache struct {
+	mutex sync.Mutex
+	zones map[string]*zoneEntry
+	// bumped by Invalidate, a list that started before an invalidation of the
+	// zone is not stored
+	generations map[string]uint64
+}
+
+type zoneEntry struct {
+	records []DnsRecord
+	fetched time.Time
+}
+
+// NewZoneCache returns an empty cache
+func NewZoneCache() *ZoneCache {
+	return &ZoneCache{zones: map[string]*zoneEntry{}, generations: map[string]uint64{}}
+}
+
+// Records returns the cached records of the zone, calling list to refresh them
+// when they are missing or older than ZoneCacheTTL
+func (c *ZoneCache) Records(ctx context.Context, zone string, list func(ctx context.Context) ([]DnsRecord, error)) ([]DnsRecord, error) {
+	if records, ok := c.Fresh(zone); ok {
+		return records, nil
+	}
+
+	c.mutex.Lock()
+	generation := c.generations[zone]
+	c.mutex.Unlock()
+
+	records, err := list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.generations[zone] == generation {
+		c.zones[zone] = &zoneEntry{records: records, fetched: time.Now()}
+	}
+	return records, nil
+}
+
+// Fresh returns the cached records of the zone if they have not expired
+func (c *ZoneCache) Fresh(zone string) ([]DnsRecord, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.zones[zone]
+	if !ok || time.Since(entry.fetched) > ZoneCacheTTL {
+		return nil, false
+	}
+	return entry.records, true
+}
+
+// Invalidate drops the cached records of the zone
+func (c *ZoneCache) Invalidate(zone string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.zones, zone)
+	c.generations[zone]++
+}
+
+// FindRecord returns the simple record with the fqdn and type, or nil if there
+// is none
+func FindRecord(records []DnsRecord, fqdn, recordType string) *DnsRecord {
+	return FindRecordSet(records, fqdn, recordType, "")
+}
+
+// FindRecordSet returns the record with the fqdn, type and set identifier, or
+// nil if there is none
+func FindRecordSet(records []DnsRecord, fqdn, recordType, setIdentifier string) *DnsRecord {
+	for _, r := range records {
+		if SameName(r.Fqdn, fqdn) && r.Type == recordType && r.SetIdentifier == setIdentifier {
+			return &r
+		}
+	}
+	return nil
+}
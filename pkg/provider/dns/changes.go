@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"golang.org/x/net/context"
+)
+
+// Changes are the records to create, update and delete in one call
+type Changes struct {
+	Create []DnsRecord
+	Update []DnsRecord
+	Delete []DnsRecord
+}
+
+// BatchProvider is implemented by providers that can apply several changes
+// with a single API call
+type BatchProvider interface {
+	ApplyChanges(ctx context.Context, changes Changes) error
+}
+
+// Empty returns true if there is nothing to change
+func (c Changes) Empty() bool {
+	return len(c.Create) == 0 && len(c.Update) == 0 && len(c.Delete) == 0
+}
+
+// Add appends the other changes to the changes
+func (c *Changes) Add(other Changes) {
+	c.Create = append(c.Create, other.Create...)
+	c.Update = append(c.Update, other.Update...)
+	c.Delete = append(c.Delete, other.Delete...)
+}
+
+// ApplyChanges uses the batch API of the provider when it has one, otherwise
+// the changes are applied one record at a time, deletes first
+func ApplyChanges(ctx context.Context, provider Provider, changes Changes) error {
+	if changes.Empty() {
+		return nil
+	}
+	if batchProvider, ok := provider.(BatchProvider); ok {
+		return batchProvider.ApplyChanges(ctx, changes)
+	}
+
+	for _, record := range changes.Delete {
+		if err := provider.RemoveRecord(ctx, record); err != nil {
+			return err
+		}
+	}
+	for _, record := range changes.Update {
+		if err := provider.UpdateRecord(ctx, record); err != nil {
+			return err
+		}
+	}
+	for _, record := range changes.Create {
+		if err := provider.AddRecord(ctx, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
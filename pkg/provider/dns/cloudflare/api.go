@@ -0,0 +1,233 @@
+package cloudflare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const apiURL = "https://api.cloudflare.com/client/v4"
+
+// page sizes used when listing, 50 is the most the API accepts for zones
+const (
+	zonesPageSize   = 50
+	recordsPageSize = 100
+)
+
+// apiClient talks to the v4 API with either a scoped API token or the legacy
+// global API key
+type apiClient struct {
+	token      string
+	email      string
+	apiKey     string
+	httpClient *http.Client
+}
+
+type apiZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type apiRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content,omitempty"`
+	Proxied bool   `json:"proxied"`
+	TTL     int    `json:"ttl"`
+	// MX preference
+	Priority *int `json:"priority,omitempty"`
+	// fields of SRV and CAA records
+	Data *apiRecordData `json:"data,omitempty"`
+}
+
+type apiRecordData struct {
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Port     int    `json:"port"`
+	Target   string `json:"target,omitempty"`
+	Flags    int    `json:"flags"`
+	Tag      string `json:"tag,omitempty"`
+	Value    string `json:"value,omitempty"`
+}
+
+type apiResponse struct {
+	Success    bool            `json:"success"`
+	Errors     []apiError      `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo *apiResultInfo  `json:"result_info"`
+}
+
+type apiResultInfo struct {
+	Page       int `json:"page"`
+	TotalPages int `json:"total_pages"`
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiErrors keeps the codes of a failed request so they show up in the
+// returned errors
+type apiErrors struct {
+	status     string
+	statusCode int
+	errors     []apiError
+}
+
+func (e *apiErrors) Error() string {
+	if len(e.errors) == 0 {
+		return fmt.Sprintf("request failed with status %s", e.status)
+	}
+	messages := make([]string, len(e.errors))
+	for i, err := range e.errors {
+		messages[i] = fmt.Sprintf("%s (code %d)", err.Message, err.Code)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// listZones returns the zones with the name, or all of them if name is empty
+func (c *apiClient) listZones(ctx context.Context, name string) ([]apiZone, error) {
+	query := url.Values{}
+	if len(name) > 0 {
+		query.Set("name", name)
+	}
+
+	var zones []apiZone
+	err := c.list(ctx, "/zones", query, zonesPageSize, func(result json.RawMessage) error {
+		var page []apiZone
+		if err := json.Unmarshal(result, &page); err != nil {
+			return err
+		}
+		zones = append(zones, page...)
+		return nil
+	})
+	return zones, err
+}
+
+func (c *apiClient) getZone(ctx context.Context, zoneID string) (*apiZone, error) {
+	var zone apiZone
+	if err := c.do(ctx, "GET", "/zones/"+zoneID, nil, &zone); err != nil {
+		return nil, err
+	}
+	return &zone, nil
+}
+
+// listRecords returns the records of the zone, only the ones with the name
+// when it is set
+func (c *apiClient) listRecords(ctx context.Context, zoneID, name string) ([]apiRecord, error) {
+	query := url.Values{}
+	if len(name) > 0 {
+		query.Set("name", name)
+	}
+
+	var records []apiRecord
+	err := c.list(ctx, "/zones/"+zoneID+"/dns_records", query, recordsPageSize, func(result json.RawMessage) error {
+		var page []apiRecord
+		if err := json.Unmarshal(result, &page); err != nil {
+			return err
+		}
+		records = append(records, page...)
+		return nil
+	})
+	return records, err
+}
+
+func (c *apiClient) createRecord(ctx context.Context, zoneID string, record apiRecord) error {
+	return c.do(ctx, "POST", "/zones/"+zoneID+"/dns_records", record, nil)
+}
+
+func (c *apiClient) updateRecord(ctx context.Context, zoneID, recordID string, record apiRecord) error {
+	return c.do(ctx, "PUT", "/zones/"+zoneID+"/dns_records/"+recordID, record, nil)
+}
+
+func (c *apiClient) deleteRecord(ctx context.Context, zoneID, recordID string) error {
+	return c.do(ctx, "DELETE", "/zones/"+zoneID+"/dns_records/"+recordID, nil, nil)
+}
+
+// list requests every page of the path, add is called with the result of each
+func (c *apiClient) list(ctx context.Context, path string, query url.Values, pageSize int, add func(json.RawMessage) error) error {
+	query.Set("per_page", strconv.Itoa(pageSize))
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		resp, err := c.request(ctx, "GET", path+"?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		if err := add(resp.Result); err != nil {
+			return err
+		}
+		if resp.ResultInfo == nil || page >= resp.ResultInfo.TotalPages {
+			return nil
+		}
+	}
+}
+
+func (c *apiClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	resp, err := c.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// request sends a request through the transport of the limiter, every page of
+// a list is a request of its own
+func (c *apiClient) request(ctx context.Context, method, path string, body interface{}) (*apiResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, apiURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else {
+		req.Header.Set("X-Auth-Email", c.email)
+		req.Header.Set("X-Auth-Key", c.apiKey)
+	}
+
+	resp, err := ctxhttp.Do(ctx, c.httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	failed := &apiErrors{
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+	}
+	var apiResp apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		// throttled and unavailable responses do not always have a JSON body
+		if dns.RetryableStatus(resp.StatusCode) {
+			return nil, failed
+		}
+		return nil, fmt.Errorf("could not decode response with status %s: %v", resp.Status, err)
+	}
+	if !apiResp.Success {
+		failed.errors = apiResp.Errors
+		return nil, failed
+	}
+	return &apiResp, nil
+}
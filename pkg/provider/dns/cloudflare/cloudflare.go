@@ -2,45 +2,37 @@ package cloudflare
 
 import (
 	"fmt"
-	"os"
+	"net/http"
+	"time"
 
 	"github.com/Sirupsen/logrus"
-	api "github.com/crackcomm/cloudflare"
 	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
 	"golang.org/x/net/context"
 )
 
 type CloudflareProvider struct {
-	client *api.Client
-	zone   *api.Zone
-	ctx    context.Context
-	root   string
+	client    *apiClient
+	zone      *apiZone
+	root      string
+	cache     *dns.ZoneCache
+	transport http.RoundTripper
 }
 
 func init() {
 	logrus.Info("Registering 'cloudflare' provider")
-	dns.RegisterProvider("cloudflare", &CloudflareProvider{})
+	dns.RegisterProvider("cloudflare", func() dns.Provider { return &CloudflareProvider{cache: dns.NewZoneCache()} })
 }
 
-func (c *CloudflareProvider) Init(rootDomainName string) error {
-	var email, apiKey string
-	if email = os.Getenv("CLOUDFLARE_EMAIL"); len(email) == 0 {
-		return fmt.Errorf("CLOUDFLARE_EMAIL is not set")
-	}
-
-	if apiKey = os.Getenv("CLOUDFLARE_KEY"); len(apiKey) == 0 {
-		return fmt.Errorf("CLOUDFLARE_KEY is not set")
+func (c *CloudflareProvider) Init(ctx context.Context, rootDomainName string, options dns.Options) error {
+	client, err := c.newClient(options)
+	if err != nil {
+		return err
 	}
+	c.client = client
 
-	c.client = api.New(&api.Options{
-		Email: email,
-		Key:   apiKey,
-	})
-
-	c.ctx = context.Background()
 	c.root = dns.UnFqdn(rootDomainName)
 
-	if err := c.setZone(); err != nil {
+	if err := c.setZone(ctx); err != nil {
 		return fmt.Errorf("Failed to set zone for root domain %s: %v", c.root, err)
 	}
 
@@ -48,44 +40,148 @@ func (c *CloudflareProvider) Init(rootDomainName string) error {
 	return nil
 }
 
+// scoped API tokens are preferred over the global API key
+func (c *CloudflareProvider) newClient(options dns.Options) (*apiClient, error) {
+	client := &apiClient{
+		token:      options.Get("CLOUDFLARE_API_TOKEN"),
+		httpClient: &http.Client{Transport: c.transport},
+	}
+	if len(client.token) == 0 {
+		if client.email = options.Get("CLOUDFLARE_EMAIL"); len(client.email) == 0 {
+			return nil, fmt.Errorf("CLOUDFLARE_API_TOKEN or CLOUDFLARE_EMAIL is not set")
+		}
+
+		if client.apiKey = options.Get("CLOUDFLARE_KEY"); len(client.apiKey) == 0 {
+			return nil, fmt.Errorf("CLOUDFLARE_KEY is not set")
+		}
+	}
+	return client, nil
+}
+
+// ListZones returns the names of all the zones the credentials can read
+func (c *CloudflareProvider) ListZones(ctx context.Context, options dns.Options) ([]string, error) {
+	client, err := c.newClient(options)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := client.listZones(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("CloudFlare API call has failed: %v", err)
+	}
+	names := make([]string, len(zones))
+	for i, zone := range zones {
+		names[i] = zone.Name
+	}
+	return names, nil
+}
+
 func (*CloudflareProvider) GetName() string {
 	return "CloudFlare"
 }
 
-func (c *CloudflareProvider) HealthCheck() error {
-	_, err := c.client.Zones.Details(c.ctx, c.zone.ID)
+// DefaultRateLimit stays under the API limit of 1200 requests per 5 minutes
+func (*CloudflareProvider) DefaultRateLimit() dns.RateLimit {
+	return dns.RateLimit{Rate: 4, Burst: 10, MaxRetries: 3}
+}
+
+func (*CloudflareProvider) RetryAfter(resp *http.Response) (bool, time.Duration) {
+	return dns.RetryableResponse(resp)
+}
+
+func (c *CloudflareProvider) SetTransport(transport http.RoundTripper) {
+	c.transport = transport
+}
+
+func (c *CloudflareProvider) HealthCheck(ctx context.Context) error {
+	_, err := c.client.getZone(ctx, c.zone.ID)
 	return err
 }
 
-func (c *CloudflareProvider) AddRecord(record dns.DnsRecord) error {
+func (c *CloudflareProvider) AddRecord(ctx context.Context, record dns.DnsRecord) error {
+	defer c.cache.Invalidate(c.zone.ID)
 	for _, rec := range record.Records {
-		r := c.prepareRecord(record)
-		r.Content = rec
-		err := c.client.Records.Create(c.ctx, r)
-		if err != nil {
-			return fmt.Errorf("CloudFlare API call has failed: %v", err)
+		if err := c.createRecord(ctx, record, rec); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (c *CloudflareProvider) UpdateRecord(record dns.DnsRecord) error {
-	if err := c.RemoveRecord(record); err != nil {
+func (c *CloudflareProvider) createRecord(ctx context.Context, record dns.DnsRecord, value string) error {
+	r := c.prepareRecord(record)
+	if err := setValue(&r, value); err != nil {
+		return err
+	}
+	if err := c.client.createRecord(ctx, c.zone.ID, r); err != nil {
+		return fmt.Errorf("CloudFlare API call has failed: %v", err)
+	}
+	return nil
+}
+
+// UpdateRecord changes the existing records in place, records are only
+// created or deleted when the number of values changes
+func (c *CloudflareProvider) UpdateRecord(ctx context.Context, record dns.DnsRecord) error {
+	defer c.cache.Invalidate(c.zone.ID)
+	existing, err := c.findRecords(ctx, record)
+	if err != nil {
 		return err
 	}
+	// keep the proxied setting if it is not managed
+	if record.Proxied == nil {
+		record.Proxied = proxied(existing)
+	}
+
+	var current []string
+	byValue := map[string][]apiRecord{}
+	for _, rec := range existing {
+		value := recordValue(rec)
+		current = append(current, value)
+		byValue[value] = append(byValue[value], rec)
+	}
+	take := func(value string) apiRecord {
+		rec := byValue[value][0]
+		byValue[value] = byValue[value][1:]
+		return rec
+	}
 
-	return c.AddRecord(record)
+	update := func(from, to string) error {
+		rec := take(from)
+		r := c.prepareRecord(record)
+		if err := setValue(&r, to); err != nil {
+			return err
+		}
+		// proxied records always get an automatic TTL
+		if from == to && rec.Proxied == r.Proxied && (rec.TTL == r.TTL || rec.Proxied) {
+			return nil
+		}
+		if err := c.client.updateRecord(ctx, c.zone.ID, rec.ID, r); err != nil {
+			return fmt.Errorf("CloudFlare API call has failed: %v", err)
+		}
+		return nil
+	}
+	create := func(value string) error {
+		return c.createRecord(ctx, record, value)
+	}
+	remove := func(value string) error {
+		if err := c.client.deleteRecord(ctx, c.zone.ID, take(value).ID); err != nil {
+			return fmt.Errorf("CloudFlare API call has failed: %v", err)
+		}
+		return nil
+	}
+
+	return dns.DiffValues(current, record.Records).Apply(update, create, remove)
 }
 
-func (c *CloudflareProvider) RemoveRecord(record dns.DnsRecord) error {
-	records, err := c.findRecords(record)
+func (c *CloudflareProvider) RemoveRecord(ctx context.Context, record dns.DnsRecord) error {
+	defer c.cache.Invalidate(c.zone.ID)
+	records, err := c.findRecords(ctx, record)
 	if err != nil {
 		return err
 	}
 
 	for _, rec := range records {
-		err := c.client.Records.Delete(c.ctx, c.zone.ID, rec.ID)
+		err := c.client.deleteRecord(ctx, c.zone.ID, rec.ID)
 		if err != nil {
 			return fmt.Errorf("CloudFlare API call has failed: %v", err)
 		}
@@ -94,72 +190,88 @@ func (c *CloudflareProvider) RemoveRecord(record dns.DnsRecord) error {
 	return nil
 }
 
-func (c *CloudflareProvider) GetRecords() ([]dns.DnsRecord, error) {
-	var records []dns.DnsRecord
-	result, err := c.client.Records.List(c.ctx, c.zone.ID)
+// GetRecords returns the records of the zone, listed at most once per
+// dns.ZoneCacheTTL
+func (c *CloudflareProvider) GetRecords(ctx context.Context) ([]dns.DnsRecord, error) {
+	return c.cache.Records(ctx, c.zone.ID, c.listRecords)
+}
+
+func (c *CloudflareProvider) listRecords(ctx context.Context) ([]dns.DnsRecord, error) {
+	result, err := c.client.listRecords(ctx, c.zone.ID, "")
 	if err != nil {
-		return records, fmt.Errorf("CloudFlare API call has failed: %v", err)
+		return nil, fmt.Errorf("CloudFlare API call has failed: %v", err)
 	}
+	return toDnsRecords(result), nil
+}
 
+func toDnsRecords(result []apiRecord) []dns.DnsRecord {
+	var records []dns.DnsRecord
 	recordMap := map[string]map[string][]string{}
 	recordTTLs := map[string]map[string]int{}
+	recordProxied := map[string]bool{}
 
 	for _, rec := range result {
 		fqdn := dns.Fqdn(rec.Name)
-		recordTTLs[fqdn] = map[string]int{}
+		// keep the TTLs of the other types of the name
+		if _, ok := recordTTLs[fqdn]; !ok {
+			recordTTLs[fqdn] = map[string]int{}
+		}
 		recordTTLs[fqdn][rec.Type] = rec.TTL
+		if rec.Proxied {
+			recordProxied[fqdn+"/"+rec.Type] = true
+		}
+		value := recordValue(rec)
 		recordSet, exists := recordMap[fqdn]
 		if exists {
 			recordSlice, sliceExists := recordSet[rec.Type]
 			if sliceExists {
-				recordSlice = append(recordSlice, rec.Content)
+				recordSlice = append(recordSlice, value)
 				recordSet[rec.Type] = recordSlice
 			} else {
-				recordSet[rec.Type] = []string{rec.Content}
+				recordSet[rec.Type] = []string{value}
 			}
 		} else {
 			recordMap[fqdn] = map[string][]string{}
-			recordMap[fqdn][rec.Type] = []string{rec.Content}
+			recordMap[fqdn][rec.Type] = []string{value}
 		}
 	}
 
 	for fqdn, recordSet := range recordMap {
 		for recordType, recordSlice := range recordSet {
 			ttl := recordTTLs[fqdn][recordType]
-			record := dns.DnsRecord{Fqdn: fqdn, Records: recordSlice, Type: recordType, TTL: ttl}
+			proxied := recordProxied[fqdn+"/"+recordType]
+			record := dns.DnsRecord{Fqdn: fqdn, Records: recordSlice, Type: recordType, TTL: ttl, Proxied: &proxied}
 			records = append(records, record)
 		}
 	}
 
-	return records, nil
+	return records
 }
 
-func (c *CloudflareProvider) GetRecord(fqdn string) (*dns.DnsRecord, error) {
-	records, err := c.GetRecords()
-	if err != nil {
-		return nil, err
+// GetRecord uses the cached zone if it is fresh, otherwise only the records
+// with the name are listed
+func (c *CloudflareProvider) GetRecord(ctx context.Context, fqdn, recordType string) (*dns.DnsRecord, error) {
+	if records, ok := c.cache.Fresh(c.zone.ID); ok {
+		return dns.FindRecord(records, fqdn, recordType), nil
 	}
 
-	for _, r := range records {
-		// need to sanitize
-		if r.Fqdn == dns.Fqdn(fqdn) {
-			logrus.Info(r)
-			return &r, nil
-		}
+	result, err := c.client.listRecords(ctx, c.zone.ID, dns.UnFqdn(fqdn))
+	if err != nil {
+		return nil, fmt.Errorf("CloudFlare API call has failed: %v", err)
 	}
-
-	return nil, nil
+	return dns.FindRecord(toDnsRecords(result), fqdn, recordType), nil
 }
 
-func (c *CloudflareProvider) setZone() error {
-	zones, err := c.client.Zones.List(c.ctx)
+func (c *CloudflareProvider) setZone(ctx context.Context) error {
+	zones, err := c.client.listZones(ctx, c.root)
 	if err != nil {
 		return fmt.Errorf("CloudFlare API call has failed: %v", err)
 	}
 
-	for _, zone := range zones {
-		if zone.Name == c.root {
-			c.zone = zone
+	c.zone = nil
+	for i := range zones {
+		if zones[i].Name == c.root {
+			c.zone = &zones[i]
 			break
 		}
 	}
@@ -170,26 +282,43 @@ func (c *CloudflareProvider) setZone() error {
 	return nil
 }
 
-func (c *CloudflareProvider) prepareRecord(record dns.DnsRecord) *api.Record {
+func (c *CloudflareProvider) prepareRecord(record dns.DnsRecord) apiRecord {
 	name := dns.UnFqdn(record.Fqdn)
-	return &api.Record{
-		Type:   record.Type,
-		Name:   name,
-		TTL:    sanitizeTTL(record),
-		ZoneID: c.zone.ID,
+	r := apiRecord{
+		Type: record.Type,
+		Name: name,
+		TTL:  sanitizeTTL(record),
+	}
+	if record.Proxied != nil {
+		r.Proxied = *record.Proxied
+	}
+	return r
+}
+
+// CanProxy returns true if Cloudflare can proxy records of the type
+func (*CloudflareProvider) CanProxy(recordType string) bool {
+	return recordType == "A" || recordType == "AAAA" || recordType == "CNAME"
+}
+
+// proxied returns true if any of the records is proxied
+func proxied(records []apiRecord) *bool {
+	proxied := false
+	for _, rec := range records {
+		proxied = proxied || rec.Proxied
 	}
+	return &proxied
 }
 
-func (c *CloudflareProvider) findRecords(record dns.DnsRecord) ([]*api.Record, error) {
-	var records []*api.Record
-	result, err := c.client.Records.List(c.ctx, c.zone.ID)
+func (c *CloudflareProvider) findRecords(ctx context.Context, record dns.DnsRecord) ([]apiRecord, error) {
+	var records []apiRecord
+	name := dns.UnFqdn(record.Fqdn)
+	result, err := c.client.listRecords(ctx, c.zone.ID, name)
 	if err != nil {
 		return records, fmt.Errorf("CloudFlare API call has failed: %v", err)
 	}
 
-	name := dns.UnFqdn(record.Fqdn)
 	for _, rec := range result {
-		if rec.Name == name && rec.Type == record.Type {
+		if dns.SameName(rec.Name, name) && rec.Type == record.Type {
 			records = append(records, rec)
 		}
 	}
@@ -199,12 +328,25 @@ func (c *CloudflareProvider) findRecords(record dns.DnsRecord) ([]*api.Record, e
 
 // TTL must be between 120 and 86400 seconds
 func sanitizeTTL(record dns.DnsRecord) int {
-	if record.TTL < 120 {
-		logrus.Warnf("%s: Setting TTL to 120 seconds", record.Fqdn)
-		record.TTL = 120
-	} else if record.TTL > 86400 {
-		logrus.Warnf("%s: Adjusting TTL to 86400 seconds", record.Fqdn)
-		record.TTL = 86400
-	}
-	return record.TTL
+	ttl := clampTTL(record.TTL)
+	if ttl != record.TTL {
+		logrus.Warnf("%s: Adjusting TTL to %d seconds", record.Fqdn, ttl)
+	}
+	return ttl
+}
+
+func clampTTL(ttl int) int {
+	if ttl < 120 {
+		return 120
+	} else if ttl > 86400 {
+		return 86400
+	}
+	return ttl
+}
+
+// Normalize returns the record with the TTL Cloudflare accepts
+func (*CloudflareProvider) Normalize(record dns.DnsRecord) dns.DnsRecord {
+	record.TTL = clampTTL(record.TTL)
+	record.PrivateRecords = nil
+	return record
 }
@@ -0,0 +1,63 @@
+package cloudflare
+
+import (
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// setValue translates a value in presentation format to the fields of the API
+func setValue(r *apiRecord, value string) error {
+	switch r.Type {
+	case "A", "AAAA", dns.TypeTXT:
+		r.Content = value
+		return nil
+	}
+	data, err := dns.ParseRecordData(r.Type, value)
+	if err != nil {
+		return err
+	}
+	switch r.Type {
+	case dns.TypeMX:
+		r.Content = dns.UnFqdn(data.Target)
+		r.Priority = &data.Priority
+	case dns.TypeSRV:
+		r.Data = &apiRecordData{
+			Priority: data.Priority,
+			Weight:   data.Weight,
+			Port:     data.Port,
+			Target:   dns.UnFqdn(data.Target),
+		}
+	case dns.TypeCAA:
+		r.Data = &apiRecordData{Flags: data.Flags, Tag: data.Tag, Value: data.Target}
+	default:
+		r.Content = dns.UnFqdn(data.Target)
+	}
+	return nil
+}
+
+// recordValue returns the value of a record in presentation format
+func recordValue(r apiRecord) string {
+	switch r.Type {
+	case dns.TypeMX:
+		data := dns.RecordData{Target: r.Content}
+		if r.Priority != nil {
+			data.Priority = *r.Priority
+		}
+		return dns.FormatRecordData(r.Type, data)
+	case dns.TypeSRV:
+		if r.Data != nil {
+			return dns.FormatRecordData(r.Type, dns.RecordData{
+				Priority: r.Data.Priority,
+				Weight:   r.Data.Weight,
+				Port:     r.Data.Port,
+				Target:   r.Data.Target,
+			})
+		}
+	case dns.TypeCAA:
+		if r.Data != nil {
+			return dns.FormatRecordData(r.Type, dns.RecordData{Flags: r.Data.Flags, Tag: r.Data.Tag, Target: r.Data.Value})
+		}
+	case "A", "AAAA", dns.TypeTXT:
+		return r.Content
+	}
+	return dns.CanonicalRecordValue(r.Type, r.Content)
+}
@@ -0,0 +1,52 @@
+package cloudflare
+
+import (
+	"testing"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+func TestValueRoundTrip(t *testing.T) {
+	tests := []struct {
+		recordType string
+		value      string
+	}{
+		{"A", "192.0.2.1"},
+		{"AAAA", "2001:db8::1"},
+		{dns.TypeCNAME, "www.example.com."},
+		{dns.TypeTXT, "v=spf1 include:_spf.example.com ~all"},
+		{dns.TypeTXT, `say "hello"  to  spaces`},
+		{dns.TypeMX, "10 mail.example.com."},
+		{dns.TypeSRV, "10 5 443 api.example.com."},
+		{dns.TypeCAA, `0 issue "letsencrypt.org"`},
+		{dns.TypeNS, "ns1.example.com."},
+	}
+
+	for _, test := range tests {
+		r := apiRecord{Type: test.recordType}
+		if err := setValue(&r, test.value); err != nil {
+			t.Errorf("%s %q: %v", test.recordType, test.value, err)
+			continue
+		}
+		if value := recordValue(r); value != test.value {
+			t.Errorf("%s %q: read back as %q", test.recordType, test.value, value)
+		}
+	}
+}
+
+func TestCAAWhitespace(t *testing.T) {
+	for _, value := range []string{`0  issue "letsencrypt.org"`, "0\tissue\t\"letsencrypt.org\""} {
+		r := apiRecord{Type: dns.TypeCAA}
+		if err := setValue(&r, value); err != nil {
+			t.Errorf("%q: %v", value, err)
+			continue
+		}
+		if read := recordValue(r); read != `0 issue "letsencrypt.org"` {
+			t.Errorf("%q: read back as %q", value, read)
+		}
+	}
+	r := apiRecord{Type: dns.TypeCAA}
+	if err := setValue(&r, "0 issue"); err == nil {
+		t.Errorf("CAA value without a value was accepted")
+	}
+}
@@ -0,0 +1,176 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Record types with a value other than an IP
+const (
+	TypeCNAME = "CNAME"
+	TypeTXT   = "TXT"
+	TypeMX    = "MX"
+	TypeSRV   = "SRV"
+	TypeCAA   = "CAA"
+	TypeNS    = "NS"
+)
+
+// RecordData is the structured value of a record, only the fields used by the
+// record type are set. Host names always end with a dot.
+type RecordData struct {
+	// the IP of A and AAAA records, the host name of CNAME, NS, MX and SRV
+	// records, the text of TXT records without quotes and the CAA value
+	Target string
+	// MX preference and SRV priority
+	Priority int
+	// SRV only
+	Weight int
+	Port   int
+	// CAA only
+	Flags int
+	Tag   string
+}
+
+// ParseRecordData parses a value in presentation format, providers use it to
+// translate the Records of a DnsRecord to their API
+func ParseRecordData(recordType, value string) (RecordData, error) {
+	var data RecordData
+	fields := strings.Fields(value)
+	switch recordType {
+	case "A", "AAAA":
+		if net.ParseIP(value) == nil {
+			return data, fmt.Errorf("invalid %s value '%s'", recordType, value)
+		}
+		data.Target = value
+	case TypeCNAME, TypeNS:
+		if len(fields) != 1 {
+			return data, fmt.Errorf("invalid %s value '%s'", recordType, value)
+		}
+		data.Target = hostname(fields[0])
+	case TypeTXT:
+		data.Target = value
+	case TypeMX:
+		if len(fields) != 2 {
+			return data, fmt.Errorf("invalid MX value '%s', expected 'preference exchange'", value)
+		}
+		if err := parseUint16(&data.Priority, "preference", fields[0]); err != nil {
+			return data, err
+		}
+		data.Target = hostname(fields[1])
+	case TypeSRV:
+		if len(fields) != 4 {
+			return data, fmt.Errorf("invalid SRV value '%s', expected 'priority weight port target'", value)
+		}
+		for i, field := range []struct {
+			name  string
+			value *int
+		}{{"priority", &data.Priority}, {"weight", &data.Weight}, {"port", &data.Port}} {
+			if err := parseUint16(field.value, field.name, fields[i]); err != nil {
+				return data, err
+			}
+		}
+		data.Target = hostname(fields[3])
+	case TypeCAA:
+		if len(fields) < 3 {
+			return data, fmt.Errorf("invalid CAA value '%s', expected 'flags tag \"value\"'", value)
+		}
+		flags, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return data, fmt.Errorf("invalid CAA flags '%s'", fields[0])
+		}
+		data.Flags = int(flags)
+		data.Tag = strings.ToLower(fields[1])
+		// the value is the rest, its own spaces are kept
+		rest := strings.TrimSpace(value)
+		for _, field := range fields[:2] {
+			rest = strings.TrimLeftFunc(strings.TrimPrefix(rest, field), unicode.IsSpace)
+		}
+		data.Target = unquote(rest)
+	default:
+		return data, fmt.Errorf("unsupported record type '%s'", recordType)
+	}
+	return data, nil
+}
+
+// FormatRecordData returns the value in presentation format, e.g.
+// "10 5 443 api.example.com." for SRV
+func FormatRecordData(recordType string, data RecordData) string {
+	switch recordType {
+	case TypeCNAME, TypeNS:
+		return hostname(data.Target)
+	case TypeMX:
+		return fmt.Sprintf("%d %s", data.Priority, hostname(data.Target))
+	case TypeSRV:
+		return fmt.Sprintf("%d %d %d %s", data.Priority, data.Weight, data.Port, hostname(data.Target))
+	case TypeCAA:
+		return fmt.Sprintf("%d %s %s", data.Flags, strings.ToLower(data.Tag), strconv.Quote(data.Target))
+	}
+	return data.Target
+}
+
+// CanonicalRecordValue returns the value in the presentation format written by
+// FormatRecordData, or the value itself if it cannot be parsed
+func CanonicalRecordValue(recordType, value string) string {
+	data, err := ParseRecordData(recordType, value)
+	if err != nil {
+		return value
+	}
+	return FormatRecordData(recordType, data)
+}
+
+// canonicalValues returns the values in the format providers return them in,
+// IPs and alias targets are left as they are
+func canonicalValues(recordType string, values []string) []string {
+	if recordType == "A" || recordType == "AAAA" {
+		return values
+	}
+	canonical := make([]string, len(values))
+	for i, value := range values {
+		canonical[i] = CanonicalRecordValue(recordType, value)
+	}
+	return canonical
+}
+
+// Data returns the structured values of the record
+func (r DnsRecord) Data() ([]RecordData, error) {
+	data := make([]RecordData, len(r.Records))
+	for i, value := range r.Records {
+		var err error
+		if data[i], err = ParseRecordData(r.Type, value); err != nil {
+			return nil, fmt.Errorf("%s: %v", r.Fqdn, err)
+		}
+	}
+	return data, nil
+}
+
+// NewRecord returns a record with the structured values
+func NewRecord(fqdn, recordType string, ttl int, data ...RecordData) DnsRecord {
+	values := make([]string, len(data))
+	for i, d := range data {
+		values[i] = FormatRecordData(recordType, d)
+	}
+	return DnsRecord{Fqdn: Fqdn(fqdn), Type: recordType, TTL: ttl, Records: values}
+}
+
+func hostname(name string) string {
+	return Fqdn(strings.ToLower(name))
+}
+
+func parseUint16(value *int, name, field string) error {
+	n, err := strconv.ParseUint(field, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid %s '%s'", name, field)
+	}
+	*value = int(n)
+	return nil
+}
+
+func unquote(value string) string {
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		return unquoted
+	}
+	return strings.Trim(value, `"`)
+}
@@ -0,0 +1,60 @@
+package dns
+
+import (
+	"testing"
+)
+
+func TestRecordDataRoundTrip(t *testing.T) {
+	tests := []struct {
+		recordType string
+		value      string
+		data       RecordData
+	}{
+		{TypeCNAME, "www.example.com.", RecordData{Target: "www.example.com."}},
+		{TypeNS, "ns1.example.com.", RecordData{Target: "ns1.example.com."}},
+		{TypeTXT, "v=spf1 include:_spf.example.com ~all", RecordData{Target: "v=spf1 include:_spf.example.com ~all"}},
+		{TypeTXT, `say "hello"  to  spaces`, RecordData{Target: `say "hello"  to  spaces`}},
+		{TypeMX, "10 mail.example.com.", RecordData{Priority: 10, Target: "mail.example.com."}},
+		{TypeSRV, "10 5 443 api.example.com.", RecordData{Priority: 10, Weight: 5, Port: 443, Target: "api.example.com."}},
+		{TypeCAA, `0 issue "letsencrypt.org"`, RecordData{Flags: 0, Tag: "issue", Target: "letsencrypt.org"}},
+		{TypeCAA, `128 iodef "mailto:security@example.com"`, RecordData{Flags: 128, Tag: "iodef", Target: "mailto:security@example.com"}},
+	}
+
+	for _, test := range tests {
+		data, err := ParseRecordData(test.recordType, test.value)
+		if err != nil {
+			t.Errorf("%s %q: %v", test.recordType, test.value, err)
+			continue
+		}
+		if data != test.data {
+			t.Errorf("%s %q: parsed %+v, want %+v", test.recordType, test.value, data, test.data)
+		}
+		if value := FormatRecordData(test.recordType, data); value != test.value {
+			t.Errorf("%s %q: formatted as %q", test.recordType, test.value, value)
+		}
+	}
+}
+
+func TestCanonicalRecordValue(t *testing.T) {
+	tests := []struct {
+		recordType string
+		value      string
+		canonical  string
+	}{
+		{TypeCNAME, "WWW.Example.com", "www.example.com."},
+		{TypeMX, "10   mail.example.com", "10 mail.example.com."},
+		{TypeSRV, "10 5 443 API.example.com", "10 5 443 api.example.com."},
+		{TypeCAA, `0 ISSUE "letsencrypt.org"`, `0 issue "letsencrypt.org"`},
+		{TypeMX, "mail.example.com", "mail.example.com"},
+		{TypeCAA, `0  issue  "letsencrypt.org"`, `0 issue "letsencrypt.org"`},
+		{TypeCAA, "0\tissue\t\"letsencrypt.org\"", `0 issue "letsencrypt.org"`},
+		{TypeCAA, `0 issuewild "ca with spaces.example"`, `0 issuewild "ca with spaces.example"`},
+		{TypeCAA, `0 issue`, `0 issue`},
+	}
+
+	for _, test := range tests {
+		if canonical := CanonicalRecordValue(test.recordType, test.value); canonical != test.canonical {
+			t.Errorf("%s %q: got %q, want %q", test.recordType, test.value, canonical, test.canonical)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package dns
+
+// ValueChange replaces one value of a record with another
+type ValueChange struct {
+	From string
+	To   string
+}
+
+// ValueDiff is the difference between the current and desired values of a
+// record, for providers that store every value as a separate record
+type ValueDiff struct {
+	Unchanged []string
+	// removed values paired with added ones, they can be changed in place
+	Replace []ValueChange
+	Add     []string
+	Remove  []string
+}
+
+// DiffValues compares the values of a record, duplicated current values are
+// removed
+func DiffValues(current, desired []string) ValueDiff {
+	var diff ValueDiff
+	counts := map[string]int{}
+	for _, value := range current {
+		counts[value]++
+	}
+
+	var added []string
+	for _, value := range desired {
+		if counts[value] > 0 {
+			counts[value]--
+			diff.Unchanged = append(diff.Unchanged, value)
+		} else {
+			added = append(added, value)
+		}
+	}
+	var removed []string
+	for _, value := range current {
+		if counts[value] > 0 {
+			counts[value]--
+			removed = append(removed, value)
+		}
+	}
+
+	for len(added) > 0 && len(removed) > 0 {
+		diff.Replace = append(diff.Replace, ValueChange{From: removed[0], To: added[0]})
+		added, removed = added[1:], removed[1:]
+	}
+	diff.Add = added
+	diff.Remove = removed
+	return diff
+}
+
+// Apply changes the values in place first, then adds the new ones and removes
+// the old ones last so the name always has values. update is also called for
+// every unchanged value, with the same from and to, so settings like the TTL
+// can be updated. It stops at the first error.
+func (d ValueDiff) Apply(update func(from, to string) error, create, remove func(value string) error) error {
+	for _, value := range d.Unchanged {
+		if err := update(value, value); err != nil {
+			return err
+		}
+	}
+	for _, change := range d.Replace {
+		if err := update(change.From, change.To); err != nil {
+			return err
+		}
+	}
+	for _, value := range d.Add {
+		if err := create(value); err != nil {
+			return err
+		}
+	}
+	for _, value := range d.Remove {
+		if err := remove(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
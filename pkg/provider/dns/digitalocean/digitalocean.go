@@ -2,27 +2,29 @@ package digitalocean
 
 import (
 	"fmt"
-	"os"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	api "github.com/digitalocean/godo"
+	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 
 	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
-	"github.com/juju/ratelimit"
 )
 
 type DigitalOceanProvider struct {
 	client         *api.Client
 	rootDomainName string
-	limiter        *ratelimit.Bucket
+	transport      http.RoundTripper
+	cache          *dns.ZoneCache
 }
 
 const TTL = 120
 
 func init() {
-	dns.RegisterProvider("digitalocean", &DigitalOceanProvider{})
+	dns.RegisterProvider("digitalocean", func() dns.Provider { return &DigitalOceanProvider{cache: dns.NewZoneCache()} })
 }
 
 type TokenSource struct {
@@ -36,35 +38,21 @@ func (t *TokenSource) Token() (*oauth2.Token, error) {
 	return token, nil
 }
 
-func (p *DigitalOceanProvider) Init(rootDomainName string) error {
-	var pat string
-	if pat = os.Getenv("DO_PAT"); len(pat) == 0 {
-		return fmt.Errorf("DO_PAT is not set")
-	}
-
-	tokenSource := &TokenSource{
-		AccessToken: pat,
+func (p *DigitalOceanProvider) Init(ctx context.Context, rootDomainName string, options dns.Options) error {
+	if err := p.setClient(options); err != nil {
+		return err
 	}
 
-	oauthClient := oauth2.NewClient(oauth2.NoContext, tokenSource)
-	p.client = api.NewClient(oauthClient)
-
-	// DO's API is rate limited at 5000/hour.
-	doqps := (float64)(5000.0 / 3600.0)
-	p.limiter = ratelimit.NewBucketWithRate(doqps, 100)
-
 	p.rootDomainName = dns.UnFqdn(rootDomainName)
 
 	// Retrieve email address associated with this PAT.
-	p.limiter.Wait(1)
-	acct, _, err := p.client.Account.Get(oauth2.NoContext)
+	acct, _, err := p.client.Account.Get(ctx)
 	if err != nil {
 		return err
 	}
 
 	// Now confirm that domain is accessible under this PAT.
-	p.limiter.Wait(1)
-	domains, _, err := p.client.Domains.Get(oauth2.NoContext, p.rootDomainName)
+	domains, _, err := p.client.Domains.Get(ctx, p.rootDomainName)
 	if err != nil {
 		return err
 	}
@@ -74,27 +62,83 @@ func (p *DigitalOceanProvider) Init(rootDomainName string) error {
 	return nil
 }
 
+func (p *DigitalOceanProvider) setClient(options dns.Options) error {
+	var pat string
+	if pat = options.Get("DO_PAT"); len(pat) == 0 {
+		return fmt.Errorf("DO_PAT is not set")
+	}
+
+	tokenSource := &TokenSource{
+		AccessToken: pat,
+	}
+
+	// the oauth2 client sends the requests with the transport of the limiter
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: p.transport})
+	oauthClient := oauth2.NewClient(ctx, tokenSource)
+	p.client = api.NewClient(oauthClient)
+	return nil
+}
+
+// ListZones returns the names of all the domains of the account
+func (p *DigitalOceanProvider) ListZones(ctx context.Context, options dns.Options) ([]string, error) {
+	if err := p.setClient(options); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	opt := &api.ListOptions{PerPage: 200}
+	for {
+		domains, resp, err := p.client.Domains.List(ctx, opt)
+		if err != nil {
+			return nil, fmt.Errorf("API call has failed: %v", err)
+		}
+		for _, domain := range domains {
+			names = append(names, domain.Name)
+		}
+
+		if resp.Links == nil || resp.Links.IsLastPage() || len(domains) == 0 {
+			return names, nil
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get current page: %v", err)
+		}
+		opt.Page = page + 1
+	}
+}
+
 func (p *DigitalOceanProvider) GetName() string {
 	return "DigitalOcean"
 }
 
-func (p *DigitalOceanProvider) HealthCheck() error {
-	p.limiter.Wait(1)
-	_, _, err := p.client.Domains.Get(oauth2.NoContext, p.rootDomainName)
+// DefaultRateLimit stays under the API limit of 5000 requests per hour
+func (*DigitalOceanProvider) DefaultRateLimit() dns.RateLimit {
+	return dns.RateLimit{Rate: 5000.0 / 3600.0, Burst: 100, MaxRetries: 3}
+}
+
+func (*DigitalOceanProvider) RetryAfter(resp *http.Response) (bool, time.Duration) {
+	return dns.RetryableResponse(resp)
+}
+
+func (p *DigitalOceanProvider) SetTransport(transport http.RoundTripper) {
+	p.transport = transport
+}
+
+func (p *DigitalOceanProvider) HealthCheck(ctx context.Context) error {
+	_, _, err := p.client.Domains.Get(ctx, p.rootDomainName)
 	return err
 }
 
-func (p *DigitalOceanProvider) AddRecord(record dns.DnsRecord) error {
+func (p *DigitalOceanProvider) AddRecord(ctx context.Context, record dns.DnsRecord) error {
+	defer p.cache.Invalidate(p.rootDomainName)
 	for _, r := range record.Records {
-		createRequest := &api.DomainRecordEditRequest{
-			Type: record.Type,
-			Name: record.Fqdn,
-			Data: r,
+		createRequest, err := editRequest(record, r)
+		if err != nil {
+			return err
 		}
 
 		logrus.Debugf("Creating record: %v", createRequest)
-		p.limiter.Wait(1)
-		_, _, err := p.client.Domains.CreateRecord(oauth2.NoContext, p.rootDomainName, createRequest)
+		_, _, err = p.client.Domains.CreateRecord(ctx, p.rootDomainName, createRequest)
 		if err != nil {
 			return fmt.Errorf("API call has failed: %v", err)
 		}
@@ -103,17 +147,61 @@ func (p *DigitalOceanProvider) AddRecord(record dns.DnsRecord) error {
 	return nil
 }
 
-func (p *DigitalOceanProvider) UpdateRecord(record dns.DnsRecord) error {
-	if err := p.RemoveRecord(record); err != nil {
-		return err
+// UpdateRecord edits the existing records in place, records are only created
+// or deleted when the number of values changes
+func (p *DigitalOceanProvider) UpdateRecord(ctx context.Context, record dns.DnsRecord) error {
+	defer p.cache.Invalidate(p.rootDomainName)
+	doRecords, err := p.fetchDoRecords(ctx)
+	if err != nil {
+		return fmt.Errorf("UpdateRecord: %v", err)
+	}
+
+	var current []string
+	byValue := map[string][]api.DomainRecord{}
+	for _, rec := range doRecords {
+		if dns.SameName(p.nameToFqdn(rec.Name), record.Fqdn) && rec.Type == record.Type {
+			value := recordValue(rec)
+			current = append(current, value)
+			byValue[value] = append(byValue[value], rec)
+		}
+	}
+	take := func(value string) api.DomainRecord {
+		rec := byValue[value][0]
+		byValue[value] = byValue[value][1:]
+		return rec
+	}
+
+	update := func(from, to string) error {
+		rec := take(from)
+		// DigitalOcean does not have per-record TTLs, nothing else to update
+		if from == to {
+			return nil
+		}
+		request, err := editRequest(record, to)
+		if err != nil {
+			return err
+		}
+		logrus.Debugf("Editing record %d: %v", rec.ID, request)
+		_, _, err = p.client.Domains.EditRecord(ctx, p.rootDomainName, rec.ID, request)
+		if err != nil {
+			return fmt.Errorf("API call has failed: %v", err)
+		}
+		return nil
+	}
+	create := func(value string) error {
+		return p.AddRecord(ctx, dns.DnsRecord{Fqdn: record.Fqdn, Type: record.Type, Records: []string{value}})
+	}
+	remove := func(value string) error {
+		return p.deleteRecord(ctx, take(value))
 	}
 
-	return p.AddRecord(record)
+	return dns.DiffValues(current, record.Records).Apply(update, create, remove)
 }
 
-func (p *DigitalOceanProvider) RemoveRecord(record dns.DnsRecord) error {
+func (p *DigitalOceanProvider) RemoveRecord(ctx context.Context, record dns.DnsRecord) error {
+	defer p.cache.Invalidate(p.rootDomainName)
 	// We need to fetch paginated results to get all records
-	doRecords, err := p.fetchDoRecords()
+	doRecords, err := p.fetchDoRecords(ctx)
 	if err != nil {
 		return fmt.Errorf("RemoveRecord: %v", err)
 	}
@@ -121,12 +209,9 @@ func (p *DigitalOceanProvider) RemoveRecord(record dns.DnsRecord) error {
 	for _, rec := range doRecords {
 		// DO records don't have fully-qualified names like ours
 		fqdn := p.nameToFqdn(rec.Name)
-		if fqdn == record.Fqdn && rec.Type == record.Type {
-			p.limiter.Wait(1)
-			logrus.Debugf("Deleting record: %v", rec)
-			_, err := p.client.Domains.DeleteRecord(oauth2.NoContext, p.rootDomainName, rec.ID)
-			if err != nil {
-				return fmt.Errorf("API call has failed: %v", err)
+		if dns.SameName(fqdn, record.Fqdn) && rec.Type == record.Type {
+			if err := p.deleteRecord(ctx, rec); err != nil {
+				return err
 			}
 		}
 	}
@@ -134,10 +219,25 @@ func (p *DigitalOceanProvider) RemoveRecord(record dns.DnsRecord) error {
 	return nil
 }
 
-func (p *DigitalOceanProvider) GetRecords() ([]dns.DnsRecord, error) {
+func (p *DigitalOceanProvider) deleteRecord(ctx context.Context, rec api.DomainRecord) error {
+	logrus.Debugf("Deleting record: %v", rec)
+	_, err := p.client.Domains.DeleteRecord(ctx, p.rootDomainName, rec.ID)
+	if err != nil {
+		return fmt.Errorf("API call has failed: %v", err)
+	}
+	return nil
+}
+
+// GetRecords returns the records of the domain, listed at most once per
+// dns.ZoneCacheTTL
+func (p *DigitalOceanProvider) GetRecords(ctx context.Context) ([]dns.DnsRecord, error) {
+	return p.cache.Records(ctx, p.rootDomainName, p.listRecords)
+}
+
+func (p *DigitalOceanProvider) listRecords(ctx context.Context) ([]dns.DnsRecord, error) {
 	dnsRecords := []dns.DnsRecord{}
 	recordMap := map[string]map[string][]string{}
-	doRecords, err := p.fetchDoRecords()
+	doRecords, err := p.fetchDoRecords(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("GetRecords: %v", err)
 	}
@@ -148,14 +248,14 @@ func (p *DigitalOceanProvider) GetRecords() ([]dns.DnsRecord, error) {
 		if exists {
 			recordSlice, sliceExists := recordSet[rec.Type]
 			if sliceExists {
-				recordSlice = append(recordSlice, rec.Data)
+				recordSlice = append(recordSlice, recordValue(rec))
 				recordSet[rec.Type] = recordSlice
 			} else {
-				recordSet[rec.Type] = []string{rec.Data}
+				recordSet[rec.Type] = []string{recordValue(rec)}
 			}
 		} else {
 			recordMap[fqdn] = map[string][]string{}
-			recordMap[fqdn][rec.Type] = []string{rec.Data}
+			recordMap[fqdn][rec.Type] = []string{recordValue(rec)}
 		}
 	}
 
@@ -170,33 +270,30 @@ func (p *DigitalOceanProvider) GetRecords() ([]dns.DnsRecord, error) {
 	return dnsRecords, nil
 }
 
-func (c *DigitalOceanProvider) GetRecord(fqdn string) (*dns.DnsRecord, error) {
-	records, err := c.GetRecords()
+// Normalize returns the record with the domain-wide TTL
+func (*DigitalOceanProvider) Normalize(record dns.DnsRecord) dns.DnsRecord {
+	record.TTL = TTL
+	record.PrivateRecords = nil
+	return record
+}
+
+func (c *DigitalOceanProvider) GetRecord(ctx context.Context, fqdn, recordType string) (*dns.DnsRecord, error) {
+	records, err := c.GetRecords(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	for _, r := range records {
-		// need to sanitize
-		if r.Fqdn == dns.Fqdn(fqdn) {
-			logrus.Info(r)
-			return &r, nil
-		}
-	}
-
-	return nil, nil
+	return dns.FindRecord(records, fqdn, recordType), nil
 }
 
 // fetchDoRecords retrieves all records for the root domain from Digital Ocean.
-func (p *DigitalOceanProvider) fetchDoRecords() ([]api.DomainRecord, error) {
+func (p *DigitalOceanProvider) fetchDoRecords(ctx context.Context) ([]api.DomainRecord, error) {
 	doRecords := []api.DomainRecord{}
 	opt := &api.ListOptions{
 		// Use the maximum of 200 records per page
 		PerPage: 200,
 	}
 	for {
-		p.limiter.Wait(1)
-		records, resp, err := p.client.Domains.Records(oauth2.NoContext, p.rootDomainName, opt)
+		records, resp, err := p.client.Domains.Records(ctx, p.rootDomainName, opt)
 		if err != nil {
 			return nil, fmt.Errorf("API call has failed: %v", err)
 		}
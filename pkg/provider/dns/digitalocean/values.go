@@ -0,0 +1,50 @@
+package digitalocean
+
+import (
+	api "github.com/digitalocean/godo"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// editRequest translates a value in presentation format to the fields of the
+// API, host names keep their trailing dot
+func editRequest(record dns.DnsRecord, value string) (*api.DomainRecordEditRequest, error) {
+	request := &api.DomainRecordEditRequest{
+		Type: record.Type,
+		Name: record.Fqdn,
+		Data: value,
+	}
+	switch record.Type {
+	case "A", "AAAA", dns.TypeTXT:
+		return request, nil
+	}
+	data, err := dns.ParseRecordData(record.Type, value)
+	if err != nil {
+		return nil, err
+	}
+	request.Data = data.Target
+	request.Priority = data.Priority
+	request.Weight = data.Weight
+	request.Port = data.Port
+	request.Flags = data.Flags
+	request.Tag = data.Tag
+	return request, nil
+}
+
+// recordValue returns the value of a record in presentation format
+func recordValue(r api.DomainRecord) string {
+	switch r.Type {
+	case "A", "AAAA", dns.TypeTXT:
+		return r.Data
+	case dns.TypeMX, dns.TypeSRV, dns.TypeCAA, dns.TypeCNAME, dns.TypeNS:
+		return dns.FormatRecordData(r.Type, dns.RecordData{
+			Target:   r.Data,
+			Priority: r.Priority,
+			Weight:   r.Weight,
+			Port:     r.Port,
+			Flags:    r.Flags,
+			Tag:      r.Tag,
+		})
+	}
+	return r.Data
+}
@@ -0,0 +1,49 @@
+package digitalocean
+
+import (
+	"testing"
+
+	api "github.com/digitalocean/godo"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+func TestValueRoundTrip(t *testing.T) {
+	tests := []struct {
+		recordType string
+		value      string
+	}{
+		{"A", "192.0.2.1"},
+		{"AAAA", "2001:db8::1"},
+		{dns.TypeCNAME, "www.example.com."},
+		{dns.TypeTXT, "v=spf1 include:_spf.example.com ~all"},
+		{dns.TypeTXT, `say "hello"  to  spaces`},
+		{dns.TypeMX, "10 mail.example.com."},
+		{dns.TypeSRV, "10 5 443 api.example.com."},
+		{dns.TypeCAA, `0 issue "letsencrypt.org"`},
+		{dns.TypeNS, "ns1.example.com."},
+	}
+
+	for _, test := range tests {
+		record := dns.DnsRecord{Fqdn: "example.com.", Type: test.recordType}
+		request, err := editRequest(record, test.value)
+		if err != nil {
+			t.Errorf("%s %q: %v", test.recordType, test.value, err)
+			continue
+		}
+		// the record as the API returns it once created with the request
+		created := api.DomainRecord{
+			Type:     request.Type,
+			Name:     request.Name,
+			Data:     request.Data,
+			Priority: request.Priority,
+			Port:     request.Port,
+			Weight:   request.Weight,
+			Flags:    request.Flags,
+			Tag:      request.Tag,
+		}
+		if value := recordValue(created); value != test.value {
+			t.Errorf("%s %q: read back as %q", test.recordType, test.value, value)
+		}
+	}
+}
@@ -2,48 +2,40 @@ package dnsimple
 
 import (
 	"fmt"
-	"os"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
-	"github.com/juju/ratelimit"
 	api "github.com/weppos/go-dnsimple/dnsimple"
+	"golang.org/x/net/context"
 )
 
+// The DNSimple client does not accept a context, so deadlines and cancellation
+// are not honored by its API calls
 type DNSimpleProvider struct {
-	client  *api.Client
-	root    string
-	limiter *ratelimit.Bucket
+	client    *api.Client
+	root      string
+	transport http.RoundTripper
+	cache     *dns.ZoneCache
 }
 
 func init() {
 	logrus.Info("Registering 'dnsimple' provider")
-	dns.RegisterProvider("dnsimple", &DNSimpleProvider{})
+	dns.RegisterProvider("dnsimple", func() dns.Provider { return &DNSimpleProvider{cache: dns.NewZoneCache()} })
 }
 
-func (d *DNSimpleProvider) Init(rootDomainName string) error {
-	var email, apiToken string
-	if email = os.Getenv("DNSIMPLE_EMAIL"); len(email) == 0 {
-		return fmt.Errorf("DNSIMPLE_EMAIL is not set")
-	}
-
-	if apiToken = os.Getenv("DNSIMPLE_TOKEN"); len(apiToken) == 0 {
-		return fmt.Errorf("DNSIMPLE_TOKEN is not set")
-	}
-
+func (d *DNSimpleProvider) Init(ctx context.Context, rootDomainName string, options dns.Options) error {
 	d.root = dns.UnFqdn(rootDomainName)
-	d.client = api.NewClient(apiToken, email)
-	d.limiter = ratelimit.NewBucketWithRate(1.5, 5)
-
-	domains, _, err := d.client.Domains.List()
+	domains, err := d.ListZones(ctx, options)
 	if err != nil {
-		return fmt.Errorf("Failed to list zones: %v", err)
+		return err
 	}
 
 	found := false
 	for _, domain := range domains {
-		if domain.Name == d.root {
+		if domain == d.root {
 			found = true
 			break
 		}
@@ -57,52 +49,108 @@ func (d *DNSimpleProvider) Init(rootDomainName string) error {
 	return nil
 }
 
+// ListZones returns the names of all the domains of the account
+func (d *DNSimpleProvider) ListZones(ctx context.Context, options dns.Options) ([]string, error) {
+	var email, apiToken string
+	if email = options.Get("DNSIMPLE_EMAIL"); len(email) == 0 {
+		return nil, fmt.Errorf("DNSIMPLE_EMAIL is not set")
+	}
+
+	if apiToken = options.Get("DNSIMPLE_TOKEN"); len(apiToken) == 0 {
+		return nil, fmt.Errorf("DNSIMPLE_TOKEN is not set")
+	}
+
+	d.client = api.NewClient(apiToken, email)
+	d.client.HttpClient = &http.Client{Transport: d.transport}
+
+	domains, _, err := d.client.Domains.List()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list zones: %v", err)
+	}
+	names := make([]string, len(domains))
+	for i, domain := range domains {
+		names[i] = domain.Name
+	}
+	return names, nil
+}
+
 func (*DNSimpleProvider) GetName() string {
 	return "DNSimple"
 }
 
-func (d *DNSimpleProvider) HealthCheck() error {
-	d.limiter.Wait(1)
+func (*DNSimpleProvider) DefaultRateLimit() dns.RateLimit {
+	return dns.RateLimit{Rate: 1.5, Burst: 5, MaxRetries: 3}
+}
+
+func (*DNSimpleProvider) RetryAfter(resp *http.Response) (bool, time.Duration) {
+	return dns.RetryableResponse(resp)
+}
+
+func (d *DNSimpleProvider) SetTransport(transport http.RoundTripper) {
+	d.transport = transport
+}
+
+func (d *DNSimpleProvider) HealthCheck(ctx context.Context) error {
 	_, _, err := d.client.Users.User()
 	return err
 }
 
+// DNSimple uses the TTL of the zone for records created without one
+const defaultTTL = 3600
+
+// Normalize returns the record with the TTL DNSimple stores
+func (*DNSimpleProvider) Normalize(record dns.DnsRecord) dns.DnsRecord {
+	if record.TTL == 0 {
+		record.TTL = defaultTTL
+	}
+	record.PrivateRecords = nil
+	return record
+}
+
 func (d *DNSimpleProvider) parseName(record dns.DnsRecord) string {
 	name := strings.TrimSuffix(record.Fqdn, fmt.Sprintf(".%s.", d.root))
 	return name
 }
 
-func (d *DNSimpleProvider) AddRecord(record dns.DnsRecord) error {
+func (d *DNSimpleProvider) AddRecord(ctx context.Context, record dns.DnsRecord) error {
+	defer d.cache.Invalidate(d.root)
 	name := d.parseName(record)
 	for _, rec := range record.Records {
-		recordInput := api.Record{
-			Name:    name,
-			TTL:     record.TTL,
-			Type:    record.Type,
-			Content: rec,
-		}
-		d.limiter.Wait(1)
-		_, _, err := d.client.Domains.CreateRecord(d.root, recordInput)
-		if err != nil {
-			return fmt.Errorf("DNSimple API call has failed: %v", err)
+		if err := d.createRecord(ctx, name, record, rec); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (d *DNSimpleProvider) findRecords(record dns.DnsRecord) ([]api.Record, error) {
+func (d *DNSimpleProvider) createRecord(ctx context.Context, name string, record dns.DnsRecord, value string) error {
+	recordInput := api.Record{
+		Name: name,
+		TTL:  record.TTL,
+		Type: record.Type,
+	}
+	if err := setValue(&recordInput, value); err != nil {
+		return err
+	}
+	_, _, err := d.client.Domains.CreateRecord(d.root, recordInput)
+	if err != nil {
+		return fmt.Errorf("DNSimple API call has failed: %v", err)
+	}
+	return nil
+}
+
+func (d *DNSimpleProvider) findRecords(ctx context.Context, record dns.DnsRecord) ([]api.Record, error) {
 	var records []api.Record
 
-	d.limiter.Wait(1)
-	resp, _, err := d.client.Domains.ListRecords(d.root, "", "")
+	name := d.parseName(record)
+	resp, err := d.listRecords(ctx, name)
 	if err != nil {
-		return records, fmt.Errorf("DNSimple API call has failed: %v", err)
+		return records, err
 	}
 
-	name := d.parseName(record)
 	for _, rec := range resp {
-		if rec.Name == name && rec.Type == record.Type {
+		if strings.EqualFold(rec.Name, name) && rec.Type == record.Type {
 			records = append(records, rec)
 		}
 	}
@@ -110,41 +158,106 @@ func (d *DNSimpleProvider) findRecords(record dns.DnsRecord) ([]api.Record, erro
 	return records, nil
 }
 
-func (d *DNSimpleProvider) UpdateRecord(record dns.DnsRecord) error {
-	err := d.RemoveRecord(record)
+// UpdateRecord changes the existing records in place, records are only
+// created or deleted when the number of values changes
+func (d *DNSimpleProvider) UpdateRecord(ctx context.Context, record dns.DnsRecord) error {
+	defer d.cache.Invalidate(d.root)
+	existing, err := d.findRecords(ctx, record)
 	if err != nil {
 		return err
 	}
 
-	return d.AddRecord(record)
+	var current []string
+	byValue := map[string][]api.Record{}
+	for _, rec := range existing {
+		value := recordValue(rec)
+		current = append(current, value)
+		byValue[value] = append(byValue[value], rec)
+	}
+	take := func(value string) api.Record {
+		rec := byValue[value][0]
+		byValue[value] = byValue[value][1:]
+		return rec
+	}
+
+	name := d.parseName(record)
+	update := func(from, to string) error {
+		rec := take(from)
+		if from == to && rec.TTL == d.Normalize(record).TTL {
+			return nil
+		}
+		recordInput := api.Record{
+			Name: name,
+			TTL:  record.TTL,
+			Type: record.Type,
+		}
+		if err := setValue(&recordInput, to); err != nil {
+			return err
+		}
+		_, _, err := d.client.Domains.UpdateRecord(d.root, rec.Id, recordInput)
+		if err != nil {
+			return fmt.Errorf("DNSimple API call has failed: %v", err)
+		}
+		return nil
+	}
+	create := func(value string) error {
+		return d.createRecord(ctx, name, record, value)
+	}
+	remove := func(value string) error {
+		return d.deleteRecord(ctx, take(value).Id)
+	}
+
+	return dns.DiffValues(current, record.Records).Apply(update, create, remove)
 }
 
-func (d *DNSimpleProvider) RemoveRecord(record dns.DnsRecord) error {
-	records, err := d.findRecords(record)
+func (d *DNSimpleProvider) RemoveRecord(ctx context.Context, record dns.DnsRecord) error {
+	defer d.cache.Invalidate(d.root)
+	records, err := d.findRecords(ctx, record)
 	if err != nil {
 		return err
 	}
 
 	for _, rec := range records {
-		d.limiter.Wait(1)
-		_, err := d.client.Domains.DeleteRecord(d.root, rec.Id)
-		if err != nil {
-			return fmt.Errorf("DNSimple API call has failed: %v", err)
+		if err := d.deleteRecord(ctx, rec.Id); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (d *DNSimpleProvider) GetRecords() ([]dns.DnsRecord, error) {
-	var records []dns.DnsRecord
+func (d *DNSimpleProvider) deleteRecord(ctx context.Context, id int) error {
+	_, err := d.client.Domains.DeleteRecord(d.root, id)
+	if err != nil {
+		return fmt.Errorf("DNSimple API call has failed: %v", err)
+	}
+	return nil
+}
 
-	d.limiter.Wait(1)
-	recordResp, _, err := d.client.Domains.ListRecords(d.root, "", "")
+// listRecords returns the records of the zone with the name, or all of them
+// if name is empty
+func (d *DNSimpleProvider) listRecords(ctx context.Context, name string) ([]api.Record, error) {
+	resp, _, err := d.client.Domains.ListRecords(d.root, name, "")
 	if err != nil {
-		return records, fmt.Errorf("DNSimple API call has failed: %v", err)
+		return nil, fmt.Errorf("DNSimple API call has failed: %v", err)
 	}
+	return resp, nil
+}
+
+// GetRecords returns the records of the zone, listed at most once per
+// dns.ZoneCacheTTL
+func (d *DNSimpleProvider) GetRecords(ctx context.Context) ([]dns.DnsRecord, error) {
+	return d.cache.Records(ctx, d.root, func(ctx context.Context) ([]dns.DnsRecord, error) {
+		recordResp, err := d.listRecords(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		return d.toDnsRecords(recordResp), nil
+	})
+}
 
+func (d *DNSimpleProvider) toDnsRecords(recordResp []api.Record) []dns.DnsRecord {
+	var records []dns.DnsRecord
 	recordMap := map[string]map[string][]string{}
 	recordTTLs := map[string]map[string]int{}
 
@@ -156,20 +269,24 @@ func (d *DNSimpleProvider) GetRecords() ([]dns.DnsRecord, error) {
 			fqdn = fmt.Sprintf("%s.%s.", rec.Name, d.root)
 		}
 
-		recordTTLs[fqdn] = map[string]int{}
+		// keep the TTLs of the other types of the name
+		if _, ok := recordTTLs[fqdn]; !ok {
+			recordTTLs[fqdn] = map[string]int{}
+		}
 		recordTTLs[fqdn][rec.Type] = rec.TTL
+		value := recordValue(rec)
 		recordSet, exists := recordMap[fqdn]
 		if exists {
 			recordSlice, sliceExists := recordSet[rec.Type]
 			if sliceExists {
-				recordSlice = append(recordSlice, rec.Content)
+				recordSlice = append(recordSlice, value)
 				recordSet[rec.Type] = recordSlice
 			} else {
-				recordSet[rec.Type] = []string{rec.Content}
+				recordSet[rec.Type] = []string{value}
 			}
 		} else {
 			recordMap[fqdn] = map[string][]string{}
-			recordMap[fqdn][rec.Type] = []string{rec.Content}
+			recordMap[fqdn][rec.Type] = []string{value}
 		}
 	}
 
@@ -180,22 +297,19 @@ func (d *DNSimpleProvider) GetRecords() ([]dns.DnsRecord, error) {
 			records = append(records, record)
 		}
 	}
-	return records, nil
+	return records
 }
 
-func (c *DNSimpleProvider) GetRecord(fqdn string) (*dns.DnsRecord, error) {
-	records, err := c.GetRecords()
-	if err != nil {
-		return nil, err
+// GetRecord uses the cached zone if it is fresh, otherwise only the records
+// with the name are listed
+func (d *DNSimpleProvider) GetRecord(ctx context.Context, fqdn, recordType string) (*dns.DnsRecord, error) {
+	if records, ok := d.cache.Fresh(d.root); ok {
+		return dns.FindRecord(records, fqdn, recordType), nil
 	}
 
-	for _, r := range records {
-		// need to sanitize
-		if r.Fqdn == dns.Fqdn(fqdn) {
-			logrus.Info(r)
-			return &r, nil
-		}
+	recordResp, err := d.listRecords(ctx, d.parseName(dns.DnsRecord{Fqdn: dns.Fqdn(fqdn)}))
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, nil
+	return dns.FindRecord(d.toDnsRecords(recordResp), fqdn, recordType), nil
 }
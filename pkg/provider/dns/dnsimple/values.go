@@ -0,0 +1,47 @@
+package dnsimple
+
+import (
+	"fmt"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+	api "github.com/weppos/go-dnsimple/dnsimple"
+)
+
+// setValue translates a value in presentation format to the fields of the
+// API, the priority of MX and SRV records has a field of its own and host
+// names do not end with a dot
+func setValue(r *api.Record, value string) error {
+	switch r.Type {
+	case "A", "AAAA", dns.TypeTXT:
+		r.Content = value
+		return nil
+	}
+	data, err := dns.ParseRecordData(r.Type, value)
+	if err != nil {
+		return err
+	}
+	switch r.Type {
+	case dns.TypeMX:
+		r.Content = dns.UnFqdn(data.Target)
+		r.Priority = data.Priority
+	case dns.TypeSRV:
+		r.Content = fmt.Sprintf("%d %d %s", data.Weight, data.Port, dns.UnFqdn(data.Target))
+		r.Priority = data.Priority
+	case dns.TypeCAA:
+		r.Content = value
+	default:
+		r.Content = dns.UnFqdn(data.Target)
+	}
+	return nil
+}
+
+// recordValue returns the value of a record in presentation format
+func recordValue(r api.Record) string {
+	switch r.Type {
+	case "A", "AAAA", dns.TypeTXT:
+		return r.Content
+	case dns.TypeMX, dns.TypeSRV:
+		return dns.CanonicalRecordValue(r.Type, fmt.Sprintf("%d %s", r.Priority, r.Content))
+	}
+	return dns.CanonicalRecordValue(r.Type, r.Content)
+}
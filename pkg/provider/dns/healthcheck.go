@@ -0,0 +1,21 @@
+package dns
+
+// HealthCheck describes the health check of every endpoint of a record, an
+// empty Protocol means the record is not health checked
+type HealthCheck struct {
+	// HTTP, HTTPS or TCP
+	Protocol string
+	Port     int
+	// path requested by HTTP and HTTPS checks
+	Path string
+	// seconds between two checks
+	Interval int
+	// consecutive checks needed to change the status of an endpoint
+	FailureThreshold int
+}
+
+// HealthCheckProvider is implemented by providers that manage the health
+// checks of their records
+type HealthCheckProvider interface {
+	HealthCheckProtocols() []string
+}
@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// limits of RFC 1035, the name length excludes the trailing dot
+const (
+	maxLabelLength = 63
+	maxNameLength  = 253
+)
+
+// NormalizeHostname validates a host name and returns it in the form written
+// to providers: lower case, without the trailing dot and with international
+// labels converted to punycode. Labels may only hold letters, digits and
+// hyphens, not at either end (RFC 1123), the leftmost label may be a "*"
+// wildcard.
+func NormalizeHostname(name string) (string, error) {
+	if strings.TrimSpace(name) != name || strings.ContainsAny(name, " \t\r\n") {
+		return "", fmt.Errorf("invalid host name '%s': contains whitespace", name)
+	}
+	name = UnFqdn(name)
+	if len(name) == 0 {
+		return "", fmt.Errorf("invalid host name: it is empty")
+	}
+
+	// punycode keeps the case, an upper case label would be another name
+	ascii, err := idna.ToASCII(strings.ToLower(name))
+	if err != nil {
+		return "", fmt.Errorf("invalid host name '%s': %v", name, err)
+	}
+	if len(ascii) > maxNameLength {
+		return "", fmt.Errorf("invalid host name '%s': longer than %d characters", name, maxNameLength)
+	}
+
+	for i, label := range strings.Split(ascii, ".") {
+		if i == 0 && label == "*" {
+			continue
+		}
+		if err := validateLabel(label); err != nil {
+			return "", fmt.Errorf("invalid host name '%s': %v", name, err)
+		}
+	}
+	return ascii, nil
+}
+
+func validateLabel(label string) error {
+	if len(label) == 0 {
+		return fmt.Errorf("empty label")
+	}
+	if len(label) > maxLabelLength {
+		return fmt.Errorf("label '%s' is longer than %d characters", label, maxLabelLength)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label '%s' starts or ends with a hyphen", label)
+	}
+	for _, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return fmt.Errorf("label '%s' contains '%c', only letters, digits and hyphens are allowed", label, c)
+		}
+	}
+	return nil
+}
+
+// SameName returns true if both names are the same, ignoring case and the
+// trailing dot
+func SameName(x, y string) bool {
+	return strings.EqualFold(UnFqdn(x), UnFqdn(y))
+}
@@ -0,0 +1,40 @@
+package dns
+
+import (
+	"testing"
+)
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		name       string
+		normalized string
+	}{
+		{"www.Example.com.", "www.example.com"},
+		{"münchen.de", "xn--mnchen-3ya.de"},
+		{"MÜNCHEN.de", "xn--mnchen-3ya.de"},
+		{"api.München.DE", "api.xn--mnchen-3ya.de"},
+		{"xn--mnchen-3ya.de", "xn--mnchen-3ya.de"},
+		{"XN--MNCHEN-3YA.de", "xn--mnchen-3ya.de"},
+		{"*.Example.com", "*.example.com"},
+		{"*.münchen.de", "*.xn--mnchen-3ya.de"},
+	}
+
+	for _, test := range tests {
+		normalized, err := NormalizeHostname(test.name)
+		if err != nil {
+			t.Errorf("%q: %v", test.name, err)
+			continue
+		}
+		if normalized != test.normalized {
+			t.Errorf("%q: got %q, want %q", test.name, normalized, test.normalized)
+		}
+	}
+}
+
+func TestNormalizeHostnameInvalid(t *testing.T) {
+	for _, name := range []string{"", " example.com", "exa mple.com", "-a.example.com", "a..example.com", "www.*.example.com", "under_score.example.com"} {
+		if normalized, err := NormalizeHostname(name); err == nil {
+			t.Errorf("%q: got %q, want an error", name, normalized)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Options read by every rate limited provider, they override the defaults of
+// the provider type
+const (
+	// requests per second
+	RateLimitOption      = "RATE_LIMIT"
+	RateLimitBurstOption = "RATE_LIMIT_BURST"
+	// attempts after the first one for a retryable error, 0 disables retries
+	MaxRetriesOption = "MAX_RETRIES"
+)
+
+// backoff between retries when the API did not say how long to wait
+var (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// the rate goes back up by a tenth of the configured rate after this many
+// calls in a row were not throttled
+const recoverAfter = 10
+
+// RateLimit is the pace of the API calls of a provider account
+type RateLimit struct {
+	Rate       float64
+	Burst      int64
+	MaxRetries int
+}
+
+// RateLimited is implemented by providers that send their API requests
+// through the transport of a Limiter, the account sets the transport before
+// the provider is initialized
+type RateLimited interface {
+	// DefaultRateLimit is used for the options that are not set
+	DefaultRateLimit() RateLimit
+	// RetryAfter tells if the request of a response can be sent again, and
+	// how long the API asked to wait before it, 0 if it did not. It may read
+	// the body if it puts back an unread copy.
+	RetryAfter(resp *http.Response) (retryable bool, wait time.Duration)
+	// SetTransport sets the transport the API client sends requests with
+	SetTransport(transport http.RoundTripper)
+}
+
+// Limiter paces the API requests of a provider account and retries the ones
+// that got a retryable response. When the API throttles a request every
+// request of the account waits for the time it asked for and the rate is
+// halved, it recovers as requests succeed.
+type Limiter struct {
+	name       string
+	retryAfter func(resp *http.Response) (bool, time.Duration)
+
+	mutex      sync.Mutex
+	limit      RateLimit
+	rate       float64
+	bucket     bucket
+	successes  int
+	pauseUntil time.Time
+}
+
+// NewLimiter returns a limiter for the named account with the options on top
+// of the defaults
+func NewLimiter(name string, defaults RateLimit, options Options, retryAfter func(resp *http.Response) (bool, time.Duration)) (*Limiter, error) {
+	l := &Limiter{name: name, retryAfter: retryAfter}
+	if err := l.Configure(defaults, options); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Configure changes the rate limit of the limiter with the options on top of
+// the defaults
+func (l *Limiter) Configure(defaults RateLimit, options Options) error {
+	limit, err := parseRateLimit(defaults, options)
+	if err != nil {
+		return fmt.Errorf("%s: %v", l.name, err)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if limit == l.limit {
+		return nil
+	}
+	l.limit = limit
+	l.setRate(limit.Rate)
+	metrics.maxRetries.WithLabelValues(l.name).Set(float64(limit.MaxRetries))
+	return nil
+}
+
+func parseRateLimit(limit RateLimit, options Options) (RateLimit, error) {
+	if value := options.Get(RateLimitOption); len(value) > 0 {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate <= 0 {
+			return limit, fmt.Errorf("%s must be a positive number, got '%s'", RateLimitOption, value)
+		}
+		limit.Rate = rate
+	}
+	if value := options.Get(RateLimitBurstOption); len(value) > 0 {
+		burst, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || burst <= 0 {
+			return limit, fmt.Errorf("%s must be a positive integer, got '%s'", RateLimitBurstOption, value)
+		}
+		limit.Burst = burst
+	}
+	if value := options.Get(MaxRetriesOption); len(value) > 0 {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return limit, fmt.Errorf("%s must be a non-negative integer, got '%s'", MaxRetriesOption, value)
+		}
+		limit.MaxRetries = retries
+	}
+	return limit, nil
+}
+
+// setRate changes the rate of the bucket, the tokens it holds are kept so
+// lowering the rate does not let a burst through. The mutex must be held.
+func (l *Limiter) setRate(rate float64) {
+	l.rate = rate
+	l.successes = 0
+	l.bucket.setRate(time.Now(), rate, float64(l.limit.Burst))
+	metrics.rate.WithLabelValues(l.name).Set(rate)
+}
+
+// Transport returns a transport sending the requests through the limiter with
+// base, every request of an API client using it is paced and retried
+func (l *Limiter) Transport(base http.RoundTripper) http.RoundTripper {
+	return &limitedTransport{limiter: l, base: base}
+}
+
+type limitedTransport struct {
+	limiter *Limiter
+	base    http.RoundTripper
+}
+
+// RoundTrip sends the request once a token is available, and again while the
+// response is retryable and retries are left. A server error is only retried
+// for idempotent methods. The last response is returned
+// as it is so the API client reports its error.
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	l := t.limiter
+	// the body is kept to send it again
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := l.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+		attemptReq := *req
+		if body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.base.RoundTrip(&attemptReq)
+		if err != nil {
+			metrics.requests.WithLabelValues(l.name, "error").Inc()
+			return nil, err
+		}
+
+		retryable, wait := l.retryAfter(resp)
+		// the server may have made the change before failing, only requests
+		// that can be repeated without a second change are sent again
+		serverError := resp.StatusCode >= http.StatusInternalServerError
+		if serverError && !idempotent(req.Method) {
+			retryable = false
+		}
+		if !retryable {
+			if resp.StatusCode < http.StatusBadRequest {
+				l.succeeded()
+				metrics.requests.WithLabelValues(l.name, "success").Inc()
+			} else {
+				metrics.requests.WithLabelValues(l.name, "error").Inc()
+			}
+			return resp, nil
+		}
+		if wait == 0 {
+			wait = backoff(attempt)
+		}
+		if serverError {
+			// an unavailable server is not a reason to slow the account down
+			metrics.requests.WithLabelValues(l.name, "error").Inc()
+		} else {
+			metrics.requests.WithLabelValues(l.name, "throttled").Inc()
+			l.throttled(wait)
+		}
+		if attempt >= l.maxRetries() {
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		metrics.retries.WithLabelValues(l.name).Inc()
+		logrus.Warnf("%s: API request failed with status %s, retrying in %s", l.name, resp.Status, wait)
+		if serverError {
+			if err := sleep(req.Context(), wait); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// idempotent returns true for the HTTP methods whose requests have the same
+// effect when they are sent twice
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// sleep waits for the delay, it returns early with the context error if the
+// context is done first
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Wait takes a token from the bucket once the limiter is no longer paused, it
+// returns early with the context error if the context is done first
+func (l *Limiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	delay := l.pauseUntil.Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	delay += l.bucket.take(now)
+	l.mutex.Unlock()
+	if delay == 0 {
+		return nil
+	}
+
+	metrics.waitSeconds.WithLabelValues(l.name).Add(delay.Seconds())
+	return sleep(ctx, delay)
+}
+
+func (l *Limiter) maxRetries() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit.MaxRetries
+}
+
+// throttled pauses every request for wait and halves the rate, down to a
+// tenth of the configured rate
+func (l *Limiter) throttled(wait time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if until := time.Now().Add(wait); until.After(l.pauseUntil) {
+		l.pauseUntil = until
+		metrics.pausedUntil.WithLabelValues(l.name).Set(float64(until.Unix()))
+	}
+	rate := l.rate / 2
+	if min := l.limit.Rate / 10; rate < min {
+		rate = min
+	}
+	l.setRate(rate)
+}
+
+func (l *Limiter) succeeded() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate >= l.limit.Rate {
+		return
+	}
+	if l.successes++; l.successes < recoverAfter {
+		return
+	}
+	rate := l.rate + l.limit.Rate/10
+	if rate > l.limit.Rate {
+		rate = l.limit.Rate
+	}
+	l.setRate(rate)
+}
+
+// bucket is a token bucket whose rate can change without refilling it, the
+// tokens go negative for the requests waiting for one
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take reserves a token and returns how long to wait until it is available
+func (b *bucket) take(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *bucket) setRate(now time.Time, rate, burst float64) {
+	if b.last.IsZero() {
+		// a new bucket starts full
+		b.tokens = burst
+	}
+	b.refill(now)
+	b.rate = rate
+	b.burst = burst
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+func backoff(attempt int) time.Duration {
+	wait := minBackoff << uint(attempt)
+	if wait > maxBackoff || wait <= 0 {
+		return maxBackoff
+	}
+	return wait
+}
+
+// RetryAfterHeader returns how long the response asks to wait before the next
+// request, from Retry-After or from the reset time of the rate limit headers
+// some APIs send instead. It returns 0 when none of them is set.
+func RetryAfterHeader(header http.Header) time.Duration {
+	if value := header.Get("Retry-After"); len(value) > 0 {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return positive(at.Sub(time.Now()))
+		}
+	}
+	for _, key := range []string{"RateLimit-Reset", "X-RateLimit-Reset"} {
+		if value := header.Get(key); len(value) > 0 {
+			if reset, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return positive(time.Unix(reset, 0).Sub(time.Now()))
+			}
+		}
+	}
+	return 0
+}
+
+// RetryableResponse tells if the request of a response with a retryable status
+// can be sent again, after the wait the headers ask for
+func RetryableResponse(resp *http.Response) (bool, time.Duration) {
+	if !RetryableStatus(resp.StatusCode) {
+		return false, 0
+	}
+	return true, RetryAfterHeader(resp.Header)
+}
+
+// RetryableStatus returns true for the HTTP status codes of requests that can
+// be made again: throttled requests and unavailable servers
+func RetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func positive(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,54 @@
+package dns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerErrorsOnlyRetriedWhenIdempotent(t *testing.T) {
+	minBackoff = time.Millisecond
+	defer func() { minBackoff = time.Second }()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		method   string
+		requests int32
+	}{
+		{"GET", 3},
+		{"PUT", 3},
+		{"DELETE", 3},
+		{"POST", 1},
+	}
+	for _, test := range tests {
+		limiter, err := NewLimiter("test", RateLimit{Rate: 1000, Burst: 10, MaxRetries: 2}, Options{}, RetryableResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: limiter.Transport(http.DefaultTransport)}
+		atomic.StoreInt32(&requests, 0)
+		req, _ := http.NewRequest(test.method, server.URL, strings.NewReader("{}"))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("%s: %v", test.method, err)
+			continue
+		}
+		resp.Body.Close()
+		if count := atomic.LoadInt32(&requests); count != test.requests {
+			t.Errorf("%s: sent %d times, want %d", test.method, count, test.requests)
+		}
+		// unavailable servers do not slow the account down
+		if limiter.rate != 1000 {
+			t.Errorf("%s: rate lowered to %v", test.method, limiter.rate)
+		}
+	}
+}
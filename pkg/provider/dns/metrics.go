@@ -0,0 +1,61 @@
+package dns
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// metrics of the provider limiters, labeled with the account name
+var metrics = struct {
+	requests    *prometheus.CounterVec
+	retries     *prometheus.CounterVec
+	waitSeconds *prometheus.CounterVec
+	rate        *prometheus.GaugeVec
+	maxRetries  *prometheus.GaugeVec
+	pausedUntil *prometheus.GaugeVec
+}{
+	requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "external_dns",
+		Subsystem: "provider",
+		Name:      "requests_total",
+		Help:      "API calls made to the provider by result: success, error or throttled.",
+	}, []string{"provider", "result"}),
+	retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "external_dns",
+		Subsystem: "provider",
+		Name:      "retries_total",
+		Help:      "API calls made again after a retryable error.",
+	}, []string{"provider"}),
+	waitSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "external_dns",
+		Subsystem: "provider",
+		Name:      "rate_limit_wait_seconds_total",
+		Help:      "Time spent waiting for the rate limiter before API calls.",
+	}, []string{"provider"}),
+	rate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "external_dns",
+		Subsystem: "provider",
+		Name:      "rate_limit",
+		Help:      "Current rate limit in requests per second, lowered while the provider throttles.",
+	}, []string{"provider"}),
+	maxRetries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "external_dns",
+		Subsystem: "provider",
+		Name:      "max_retries",
+		Help:      "Retries allowed for an API call that failed with a retryable error.",
+	}, []string{"provider"}),
+	pausedUntil: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "external_dns",
+		Subsystem: "provider",
+		Name:      "paused_until_timestamp_seconds",
+		Help:      "Time until which API calls wait after the provider throttled one.",
+	}, []string{"provider"}),
+}
+
+func init() {
+	prometheus.MustRegister(
+		metrics.requests,
+		metrics.retries,
+		metrics.waitSeconds,
+		metrics.rate,
+		metrics.maxRetries,
+		metrics.pausedUntil,
+	)
+}
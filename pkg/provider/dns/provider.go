@@ -2,47 +2,381 @@ package dns
 
 import (
 	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
 )
 
+// Provider calls must return once the context is done
 type Provider interface {
-	Init(rootDomainName string) error
+	Init(ctx context.Context, rootDomainName string, options Options) error
 	GetName() string
-	HealthCheck() error
-	AddRecord(record DnsRecord) error
-	RemoveRecord(record DnsRecord) error
-	UpdateRecord(record DnsRecord) error
-	GetRecords() ([]DnsRecord, error)
-	GetRecord(fqdn string) (*DnsRecord, error)
+	HealthCheck(ctx context.Context) error
+	AddRecord(ctx context.Context, record DnsRecord) error
+	RemoveRecord(ctx context.Context, record DnsRecord) error
+	UpdateRecord(ctx context.Context, record DnsRecord) error
+	GetRecords(ctx context.Context) ([]DnsRecord, error)
+	GetRecord(ctx context.Context, fqdn, recordType string) (*DnsRecord, error)
+}
+
+// Options are provider specific settings such as credentials, keyed by the
+// environment variable names the provider reads.
+type Options map[string]string
+
+// Get returns the value of key, an environment variable with the same name is
+// only used when the key is not configured so that the options of an account,
+// including the ones read from a secret, are never overridden.
+func (o Options) Get(key string) string {
+	if value := o[key]; value != "" {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+// Merge returns a copy of the options with the other options on top
+func (o Options) Merge(other Options) Options {
+	merged := Options{}
+	for key, value := range o {
+		merged[key] = value
+	}
+	for key, value := range other {
+		merged[key] = value
+	}
+	return merged
+}
+
+// String only prints the keys so credentials never end up in logs
+func (o Options) String() string {
+	keys := make([]string, 0, len(o))
+	for key := range o {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf("[%s]", strings.Join(keys, " "))
+}
+
+// Factory returns a new, uninitialized provider instance
+type Factory func() Provider
+
+// account is a named provider configuration with its own options, it has a
+// provider instance per root domain
+type account struct {
+	name         string
+	providerType string
+	factory      Factory
+	options      Options
+	// options of a single zone, on top of options
+	zoneOptions map[string]Options
+	// initialized instances keyed by root domain. An instance is never
+	// initialized again, a change of options replaces it so that the calls
+	// still using it are not affected.
+	instances map[string]*instance
+	// paces the API calls of rate limited providers, shared by the instances
+	limiter *Limiter
+}
+
+type instance struct {
+	provider Provider
+	options  Options
 }
 
 var (
-	providers = make(map[string]Provider)
+	factories = make(map[string]Factory)
+	accounts  = make(map[string]*account)
+	// guards accounts and the provider Init calls, options can change from
+	// the secret watcher while services are being processed
+	mutex sync.Mutex
 )
 
-func GetProvider(name, rootDomainName string) (Provider, error) {
-	if provider, ok := providers[name]; ok {
-		if err := provider.Init(rootDomainName); err != nil {
-			return nil, err
+// GetProvider returns the named provider instance initialized for the root
+// domain. A name that was not configured but matches a provider type gets an
+// instance of that type reading its options from the environment.
+func GetProvider(ctx context.Context, name, rootDomainName string) (Provider, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	acct, err := getAccount(name)
+	if err != nil {
+		return nil, err
+	}
+	if inst, ok := acct.instances[rootDomainName]; ok {
+		return inst.provider, nil
+	}
+	inst, err := acct.newInstance(ctx, rootDomainName)
+	if err != nil {
+		return nil, err
+	}
+	acct.instances[rootDomainName] = inst
+	return inst.provider, nil
+}
+
+// Capabilities returns an uninitialized instance of the named provider, the
+// optional interfaces it implements tell what it supports. Nothing is sent to
+// the provider.
+func Capabilities(name string) (Provider, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if acct, ok := accounts[name]; ok {
+		return acct.factory(), nil
+	}
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("No such provider '%s'", name)
+	}
+	return factory(), nil
+}
+
+// ZoneLister is implemented by providers that can list the zones an account
+// has access to, without being initialized for a root domain
+type ZoneLister interface {
+	ListZones(ctx context.Context, options Options) ([]string, error)
+}
+
+// ListZones returns the names of the zones the named provider instance has
+// access to
+func ListZones(ctx context.Context, name string) ([]string, error) {
+	mutex.Lock()
+	acct, err := getAccount(name)
+	if err != nil {
+		mutex.Unlock()
+		return nil, err
+	}
+	// a new instance so that concurrent calls do not share a client
+	provider := acct.create()
+	options := acct.options
+	mutex.Unlock()
+
+	lister, ok := provider.(ZoneLister)
+	if !ok {
+		return nil, fmt.Errorf("%s: provider %s cannot list zones", name, provider.GetName())
+	}
+	return lister.ListZones(ctx, options)
+}
+
+// Configure sets up a named provider instance of a registered type, services
+// reference the instance by name in their provider annotation. Configuring an
+// existing instance again replaces its initialized instances with new ones
+// using the new options. Zone options are keyed by root domain and override
+// options for that zone.
+func Configure(ctx context.Context, name, providerType string, options Options, zoneOptions map[string]Options) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	factory, ok := factories[providerType]
+	if !ok {
+		return fmt.Errorf("%s: no such provider type '%s'", name, providerType)
+	}
+
+	acct, exists := accounts[name]
+	if !exists || acct.providerType != providerType {
+		acct = newAccount(name, providerType, factory)
+		acct.options = options
+		acct.zoneOptions = zoneOptions
+		if err := acct.setLimiter(); err != nil {
+			return err
+		}
+		accounts[name] = acct
+		logrus.Infof("%s: configured '%s' provider with options %s", name, providerType, options)
+		return nil
+	}
+
+	acct.options = options
+	acct.zoneOptions = zoneOptions
+	logrus.Infof("%s: options changed to %s, re-initializing '%s' provider", name, options, providerType)
+	if err := acct.setLimiter(); err != nil {
+		return err
+	}
+	var errs []string
+	for rootDomainName, current := range acct.instances {
+		// the zones of the root domain were resolved by Init, they are only
+		// resolved again when the options of the zone change
+		if reflect.DeepEqual(current.options, acct.optionsFor(rootDomainName)) {
+			continue
+		}
+		inst, err := acct.newInstance(ctx, rootDomainName)
+		if err != nil {
+			// the previous instance is kept until the new options work
+			errs = append(errs, fmt.Sprintf("%s: %v", rootDomainName, err))
+			continue
 		}
-		return provider, nil
+		acct.instances[rootDomainName] = inst
 	}
-	return nil, fmt.Errorf("No such provider '%s'", name)
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: could not re-initialize provider: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// getAccount returns the named account, a provider type that was not
+// configured gets an account of its own. The mutex must be held.
+func getAccount(name string) (*account, error) {
+	if acct, ok := accounts[name]; ok {
+		return acct, nil
+	}
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("No such provider '%s'", name)
+	}
+	acct := newAccount(name, name, factory)
+	if err := acct.setLimiter(); err != nil {
+		return nil, err
+	}
+	accounts[name] = acct
+	return acct, nil
+}
+
+func newAccount(name, providerType string, factory Factory) *account {
+	return &account{
+		name:         name,
+		providerType: providerType,
+		factory:      factory,
+		instances:    map[string]*instance{},
+	}
+}
+
+// create returns a new, uninitialized instance sending its requests through
+// the limiter of the account
+func (acct *account) create() Provider {
+	provider := acct.factory()
+	if limited, ok := provider.(RateLimited); ok && acct.limiter != nil {
+		limited.SetTransport(acct.limiter.Transport(http.DefaultTransport))
+	}
+	return provider
+}
+
+// newInstance returns a new instance initialized for the root domain
+func (acct *account) newInstance(ctx context.Context, rootDomainName string) (*instance, error) {
+	options := acct.optionsFor(rootDomainName)
+	provider := acct.create()
+	if err := provider.Init(ctx, rootDomainName, options); err != nil {
+		return nil, err
+	}
+	return &instance{provider: provider, options: options}, nil
+}
+
+func (acct *account) optionsFor(rootDomainName string) Options {
+	zoneOptions, ok := acct.zoneOptions[strings.ToLower(UnFqdn(rootDomainName))]
+	if !ok {
+		return acct.options
+	}
+	return acct.options.Merge(zoneOptions)
+}
+
+// setLimiter creates the limiter of a rate limited provider, or updates its
+// rate limit with the account options
+func (acct *account) setLimiter() error {
+	limited, ok := acct.factory().(RateLimited)
+	if !ok {
+		return nil
+	}
+	if acct.limiter != nil {
+		return acct.limiter.Configure(limited.DefaultRateLimit(), acct.options)
+	}
+	limiter, err := NewLimiter(acct.name, limited.DefaultRateLimit(), acct.options, limited.RetryAfter)
+	if err != nil {
+		return err
+	}
+	acct.limiter = limiter
+	return nil
 }
 
-func RegisterProvider(name string, provider Provider) {
-	if _, exists := providers[name]; exists {
-		logrus.Errorf("Provider '%s' tried to register twice", name)
+// RegisterProvider makes a provider type available to GetProvider and Configure
+func RegisterProvider(providerType string, factory Factory) {
+	if _, exists := factories[providerType]; exists {
+		logrus.Errorf("Provider '%s' tried to register twice", providerType)
 	}
-	providers[name] = provider
+	factories[providerType] = factory
+}
+
+// Registered returns true if the provider type was registered
+func Registered(providerType string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, ok := factories[providerType]
+	return ok
 }
 
 type DnsRecord struct {
-	Fqdn    string
+	Fqdn string
+	// Records are the values in presentation format so they can be compared
+	// as strings, Data returns them structured
 	Records []string
 	Type    string
 	TTL     int
+	// PrivateRecords are written instead of Records to private zones by
+	// providers with split-horizon support
+	PrivateRecords []string
+	// SetIdentifier tells apart the record sets sharing a name and type, it
+	// is only set together with a routing policy
+	SetIdentifier string
+	Routing       RoutingPolicy
+	HealthCheck   HealthCheck
+	// Alias records point at the load balancer hostname in Records instead
+	// of resolving it
+	Alias bool
+	// Proxied records are served through the CDN of the provider, nil keeps
+	// the current setting
+	Proxied *bool
+}
+
+// Normalizer is implemented by providers that do not store every field of a
+// record, Normalize returns the record as GetRecords would return it once written
+type Normalizer interface {
+	Normalize(record DnsRecord) DnsRecord
+}
+
+// AliasProvider is implemented by providers that can point a record at the
+// hostname of a load balancer, including at the zone apex
+type AliasProvider interface {
+	CanAlias(hostname string) bool
+}
+
+// ProxyProvider is implemented by providers that can serve records through
+// their CDN
+type ProxyProvider interface {
+	CanProxy(recordType string) bool
+}
+
+// Normalize returns the record as the provider would return it once written,
+// providers without split-horizon support drop PrivateRecords
+func Normalize(provider Provider, record DnsRecord) DnsRecord {
+	record.Records = canonicalValues(record.Type, record.Records)
+	if normalizer, ok := provider.(Normalizer); ok {
+		return normalizer.Normalize(record)
+	}
+	record.PrivateRecords = nil
+	return record
+}
+
+// SlicesSimilar returns true if both slices hold the same values in any order
+func SlicesSimilar(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	diff := make(map[string]int, len(x))
+	for _, _x := range x {
+		diff[_x]++
+	}
+	for _, _y := range y {
+		if _, ok := diff[_y]; !ok {
+			return false
+		}
+		diff[_y]--
+		if diff[_y] == 0 {
+			delete(diff, _y)
+		}
+	}
+	if len(diff) == 0 {
+		return true
+	}
+	return false
 }
 
 // Fqdn ensures that the name is a fqdn adding a trailing dot if necessary.
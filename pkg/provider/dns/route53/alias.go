@@ -0,0 +1,90 @@
+package route53
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsRoute53 "github.com/aws/aws-sdk-go/service/route53"
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// canonicalHostedZones maps the hostname suffix of AWS load balancers to the
+// hosted zone ID alias targets have to use
+var canonicalHostedZones = map[string]string{
+	// Classic and Application Load Balancers
+	"us-east-2.elb.amazonaws.com":      "Z3AADJGX6KTTL2",
+	"us-east-1.elb.amazonaws.com":      "Z35SXDOTRQ7X7K",
+	"us-west-1.elb.amazonaws.com":      "Z368ELLRRE2KJ0",
+	"us-west-2.elb.amazonaws.com":      "Z1H1FL5HABSF5",
+	"ca-central-1.elb.amazonaws.com":   "ZQSVJUPU6J1EY",
+	"ap-south-1.elb.amazonaws.com":     "ZP97RAFLXTNZK",
+	"ap-northeast-2.elb.amazonaws.com": "ZWKZPGTI48KDX",
+	"ap-southeast-1.elb.amazonaws.com": "Z1LMS91P8CMLE5",
+	"ap-southeast-2.elb.amazonaws.com": "Z1GM3OXH4ZPM65",
+	"ap-northeast-1.elb.amazonaws.com": "Z14GRHDCWA56QT",
+	"eu-central-1.elb.amazonaws.com":   "Z215JYRZR1TBD5",
+	"eu-west-1.elb.amazonaws.com":      "Z32O12XQLNTSW2",
+	"eu-west-2.elb.amazonaws.com":      "ZHURV8PSTC4K8",
+	"eu-west-3.elb.amazonaws.com":      "Z3Q77PNBQS71R4",
+	"sa-east-1.elb.amazonaws.com":      "Z2P70J7HTTTPLU",
+	// Network Load Balancers
+	"elb.us-east-2.amazonaws.com":      "ZLMOA37VPKANP",
+	"elb.us-east-1.amazonaws.com":      "Z26RNL4JYFTOTI",
+	"elb.us-west-1.amazonaws.com":      "Z24FKFUX50B4VW",
+	"elb.us-west-2.amazonaws.com":      "Z18D5FSROUN65G",
+	"elb.ca-central-1.amazonaws.com":   "Z2EPGBW3API2WT",
+	"elb.ap-south-1.amazonaws.com":     "ZVDDRBQ08TROA",
+	"elb.ap-northeast-2.amazonaws.com": "ZIBE1TIR4HY56",
+	"elb.ap-southeast-1.amazonaws.com": "ZKVM4W9LS7TM",
+	"elb.ap-southeast-2.amazonaws.com": "ZCT6FZBF4NROD",
+	"elb.ap-northeast-1.amazonaws.com": "Z31USIVHYNEOWT",
+	"elb.eu-central-1.amazonaws.com":   "Z3F0SRJ5LGBH90",
+	"elb.eu-west-1.amazonaws.com":      "Z2IFOLAFXWLO4F",
+	"elb.eu-west-2.amazonaws.com":      "ZD4D7Y8KGAS4G",
+	"elb.eu-west-3.amazonaws.com":      "Z1CMS0P5QUFQWE",
+	"elb.sa-east-1.amazonaws.com":      "ZTK26PT1VY4CU",
+}
+
+// canonicalHostedZone returns the hosted zone ID of the load balancer hostname,
+// or an empty string if it is not an AWS load balancer
+func canonicalHostedZone(hostname string) string {
+	hostname = strings.ToLower(dns.UnFqdn(hostname))
+	for suffix, zoneId := range canonicalHostedZones {
+		if strings.HasSuffix(hostname, "."+suffix) {
+			return zoneId
+		}
+	}
+	return ""
+}
+
+// CanAlias returns true if the hostname is an AWS load balancer
+func (*Route53Provider) CanAlias(hostname string) bool {
+	return len(canonicalHostedZone(hostname)) > 0
+}
+
+// setAliasTarget points the record set at the load balancer instead of
+// listing values, alias record sets do not have a TTL
+func setAliasTarget(rrSet *awsRoute53.ResourceRecordSet, hostname string) {
+	rrSet.TTL = nil
+	rrSet.ResourceRecords = nil
+	rrSet.AliasTarget = &awsRoute53.AliasTarget{
+		DNSName:              aws.String(dns.Fqdn(strings.ToLower(hostname))),
+		HostedZoneId:         aws.String(canonicalHostedZone(hostname)),
+		EvaluateTargetHealth: aws.Bool(false),
+	}
+}
+
+// normalizeAlias returns the alias targets as they are read back, without a
+// TTL
+func normalizeAlias(record dns.DnsRecord) dns.DnsRecord {
+	if !record.Alias {
+		return record
+	}
+	record.TTL = 0
+	targets := make([]string, len(record.Records))
+	for i, target := range record.Records {
+		targets[i] = dns.Fqdn(strings.ToLower(target))
+	}
+	record.Records = targets
+	return record
+}
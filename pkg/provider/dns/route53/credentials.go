@@ -0,0 +1,75 @@
+package route53
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// options used to build the credentials, a change to any of them rebuilds the client
+var credentialOptions = []string{
+	"AWS_ACCESS_KEY",
+	"AWS_SECRET_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_PROFILE",
+	"AWS_ASSUME_ROLE_ARN",
+	"AWS_ASSUME_ROLE_EXTERNAL_ID",
+}
+
+const assumeRoleSessionName = "kube-external-dns"
+
+// newCredentials uses static keys when AWS_ACCESS_KEY and AWS_SECRET_KEY are
+// set, otherwise the default AWS credential chain: env variables, shared
+// config and credentials files, web identity tokens (IRSA) and the EC2/ECS
+// instance role. When AWS_ASSUME_ROLE_ARN is set these credentials are used
+// to assume the role, the SDK refreshes the role credentials before they expire.
+func newCredentials(region string, options dns.Options) (*credentials.Credentials, error) {
+	var creds *credentials.Credentials
+	accessKey, secretKey := options.Get("AWS_ACCESS_KEY"), options.Get("AWS_SECRET_KEY")
+	if len(accessKey) > 0 && len(secretKey) > 0 {
+		creds = credentials.NewStaticCredentials(accessKey, secretKey, options.Get("AWS_SESSION_TOKEN"))
+	} else if len(accessKey) > 0 || len(secretKey) > 0 {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY and AWS_SECRET_KEY must be set together")
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region:      aws.String(region),
+			Credentials: creds,
+		},
+		Profile:           options.Get("AWS_PROFILE"),
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create AWS session: %v", err)
+	}
+
+	roleARN := options.Get("AWS_ASSUME_ROLE_ARN")
+	if len(roleARN) == 0 {
+		return sess.Config.Credentials, nil
+	}
+	return stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = assumeRoleSessionName
+		if externalID := options.Get("AWS_ASSUME_ROLE_EXTERNAL_ID"); len(externalID) > 0 {
+			p.ExternalID = aws.String(externalID)
+		}
+	}), nil
+}
+
+// clientKey hashes the region and credential options so they are not kept
+// around in clear text
+func clientKey(region string, options dns.Options) string {
+	hash := sha256.New()
+	hash.Write([]byte(region))
+	for _, key := range credentialOptions {
+		hash.Write([]byte{0})
+		hash.Write([]byte(options.Get(key)))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
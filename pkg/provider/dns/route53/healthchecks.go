@@ -0,0 +1,418 @@
+package route53
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsRoute53 "github.com/aws/aws-sdk-go/service/route53"
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+	"golang.org/x/net/context"
+)
+
+// healthCheck is a health check attached to a record set, records with
+// several endpoints get a calculated health check over one child per endpoint
+type healthCheck struct {
+	config    dns.HealthCheck
+	endpoints []string
+	children  []string
+}
+
+// healthCheckChanges tracks the health checks of a change batch, the created
+// ones are deleted if the batch fails and the stale ones once it succeeds
+type healthCheckChanges struct {
+	ids     map[string]string
+	created []string
+	stale   []string
+}
+
+func (*Route53Provider) HealthCheckProtocols() []string {
+	return []string{"HTTP", "HTTPS", "TCP"}
+}
+
+// prepareHealthChecks creates the health checks of the upserted records and
+// finds the ones they replace, health checks are only attached to public zones
+func (r *Route53Provider) prepareHealthChecks(ctx context.Context, changes dns.Changes) (*healthCheckChanges, error) {
+	hc := &healthCheckChanges{ids: map[string]string{}}
+	if r.zoneType == zoneTypePrivate {
+		return hc, nil
+	}
+	public := r.zones[0]
+
+	upserts := append(append([]dns.DnsRecord{}, changes.Update...), changes.Create...)
+	for _, record := range upserts {
+		current, err := r.currentHealthCheckId(ctx, public, record)
+		if err != nil {
+			return hc, err
+		}
+		if len(record.HealthCheck.Protocol) == 0 {
+			if len(current) > 0 {
+				hc.stale = append(hc.stale, current)
+			}
+			continue
+		}
+
+		id, created, err := r.ensureHealthCheck(ctx, record, current)
+		if err != nil {
+			return hc, err
+		}
+		if created {
+			hc.created = append(hc.created, id)
+			if len(current) > 0 {
+				hc.stale = append(hc.stale, current)
+			}
+		}
+		hc.ids[healthCheckKey(record)] = id
+	}
+	return hc, nil
+}
+
+// finishHealthChecks deletes the health checks nobody refers to after the change batch,
+// failures are only logged since the records have been written already
+func (r *Route53Provider) finishHealthChecks(ctx context.Context, changes dns.Changes, hc *healthCheckChanges, err error) {
+	unused := hc.stale
+	if err != nil {
+		unused = hc.created
+		// a failed batch may have been applied to some of the zones
+		r.healthCheckMutex.Lock()
+		r.healthCheckIds = map[string]string{}
+		r.healthCheckMutex.Unlock()
+	} else if r.zoneType != zoneTypePrivate {
+		r.updateHealthCheckIds(changes, hc)
+	}
+	for _, id := range unused {
+		if err := r.deleteHealthCheck(ctx, id); err != nil {
+			logrus.Warnf("%s: could not delete health check %s: %v", r.GetName(), id, err)
+		}
+	}
+}
+
+// currentHealthCheckId returns the health check the record set refers to, as
+// seen when the zone or the name was listed last. The record sets of the name
+// are only listed if none of them was seen yet.
+func (r *Route53Provider) currentHealthCheckId(ctx context.Context, zone hostedZone, record dns.DnsRecord) (string, error) {
+	key := healthCheckKey(record)
+	r.healthCheckMutex.Lock()
+	id, ok := r.healthCheckIds[key]
+	r.healthCheckMutex.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	rrSets, err := r.listRecordSets(ctx, zone, record.Fqdn)
+	if err != nil {
+		return "", err
+	}
+	r.setHealthCheckIds(zone, record.Fqdn, rrSets)
+	r.healthCheckMutex.Lock()
+	defer r.healthCheckMutex.Unlock()
+	return r.healthCheckIds[key], nil
+}
+
+// setHealthCheckIds remembers the health checks of the listed record sets of
+// a public zone, the ones of the fqdn or of the whole zone if fqdn is empty
+func (r *Route53Provider) setHealthCheckIds(zone hostedZone, fqdn string, rrSets []*awsRoute53.ResourceRecordSet) {
+	if zone.private {
+		return
+	}
+	r.healthCheckMutex.Lock()
+	defer r.healthCheckMutex.Unlock()
+	prefix := strings.ToLower(dns.Fqdn(fqdn)) + "/"
+	for key := range r.healthCheckIds {
+		if len(fqdn) == 0 || strings.HasPrefix(key, prefix) {
+			delete(r.healthCheckIds, key)
+		}
+	}
+	for _, rrSet := range rrSets {
+		key := healthCheckKey(dns.DnsRecord{
+			Fqdn:          aws.StringValue(rrSet.Name),
+			Type:          aws.StringValue(rrSet.Type),
+			SetIdentifier: aws.StringValue(rrSet.SetIdentifier),
+		})
+		r.healthCheckIds[key] = aws.StringValue(rrSet.HealthCheckId)
+	}
+}
+
+// updateHealthCheckIds records the health checks the applied changes refer to
+func (r *Route53Provider) updateHealthCheckIds(changes dns.Changes, hc *healthCheckChanges) {
+	r.healthCheckMutex.Lock()
+	defer r.healthCheckMutex.Unlock()
+	for _, record := range changes.Delete {
+		delete(r.healthCheckIds, healthCheckKey(record))
+	}
+	for _, record := range append(append([]dns.DnsRecord{}, changes.Update...), changes.Create...) {
+		key := healthCheckKey(record)
+		r.healthCheckIds[key] = hc.ids[key]
+	}
+}
+
+// ensureHealthCheck returns the current health check if it still matches the
+// record, otherwise a new one is created
+func (r *Route53Provider) ensureHealthCheck(ctx context.Context, record dns.DnsRecord, current string) (string, bool, error) {
+	if len(current) > 0 {
+		check, err := r.describeHealthCheck(ctx, current)
+		if err != nil && !isNoSuchHealthCheck(err) {
+			return "", false, err
+		}
+		if err == nil && check.config == record.HealthCheck && dns.SlicesSimilar(check.endpoints, record.Records) {
+			return current, false, nil
+		}
+	}
+
+	if len(record.Records) == 0 {
+		return "", false, fmt.Errorf("%s has no endpoints to health check", record.Fqdn)
+	}
+	settings := record.HealthCheck
+	check := healthCheck{config: settings, endpoints: record.Records}
+	for _, endpoint := range record.Records {
+		config := &awsRoute53.HealthCheckConfig{
+			Type:             aws.String(settings.Protocol),
+			Port:             aws.Int64(int64(settings.Port)),
+			RequestInterval:  aws.Int64(int64(settings.Interval)),
+			FailureThreshold: aws.Int64(int64(settings.FailureThreshold)),
+		}
+		if settings.Protocol != "TCP" {
+			config.ResourcePath = aws.String(settings.Path)
+			config.FullyQualifiedDomainName = aws.String(dns.UnFqdn(record.Fqdn))
+		}
+		// alias targets are checked by hostname
+		if record.Alias {
+			config.FullyQualifiedDomainName = aws.String(endpoint)
+		} else {
+			config.IPAddress = aws.String(endpoint)
+		}
+		id, err := r.createHealthCheck(ctx, fmt.Sprintf("%s %s", dns.UnFqdn(record.Fqdn), endpoint), config)
+		if err != nil {
+			for _, child := range check.children {
+				r.deleteHealthCheck(ctx, child)
+			}
+			return "", false, err
+		}
+		check.children = append(check.children, id)
+	}
+
+	id := check.children[0]
+	if len(check.children) > 1 {
+		config := &awsRoute53.HealthCheckConfig{
+			Type:              aws.String("CALCULATED"),
+			ChildHealthChecks: aws.StringSlice(check.children),
+			HealthThreshold:   aws.Int64(1),
+		}
+		var err error
+		if id, err = r.createHealthCheck(ctx, dns.UnFqdn(record.Fqdn), config); err != nil {
+			for _, child := range check.children {
+				r.deleteHealthCheck(ctx, child)
+			}
+			return "", false, err
+		}
+	} else {
+		check.children = nil
+	}
+
+	r.healthCheckMutex.Lock()
+	r.healthChecks[id] = check
+	r.healthCheckMutex.Unlock()
+	logrus.Infof("%s: created health check %s for %s", r.GetName(), id, record.Fqdn)
+	return id, true, nil
+}
+
+func (r *Route53Provider) createHealthCheck(ctx context.Context, name string, config *awsRoute53.HealthCheckConfig) (string, error) {
+	// the caller reference makes the request idempotent, it has to be unique
+	// for every health check ever created
+	hash := sha256.Sum256([]byte(name))
+	params := &awsRoute53.CreateHealthCheckInput{
+		CallerReference:   aws.String(fmt.Sprintf("%s-%d", hex.EncodeToString(hash[:16]), time.Now().UnixNano())),
+		HealthCheckConfig: config,
+	}
+	resp, err := r.client.CreateHealthCheckWithContext(ctx, params)
+	if err != nil {
+		return "", fmt.Errorf("Route 53 API call has failed: %v", err)
+	}
+	id := aws.StringValue(resp.HealthCheck.Id)
+
+	// the name only makes the health check recognizable in the console
+	tags := &awsRoute53.ChangeTagsForResourceInput{
+		ResourceId:   aws.String(id),
+		ResourceType: aws.String("healthcheck"),
+		AddTags: []*awsRoute53.Tag{
+			{Key: aws.String("Name"), Value: aws.String(name)},
+			{Key: aws.String("managed-by"), Value: aws.String("kube-external-dns")},
+		},
+	}
+	_, err = r.client.ChangeTagsForResourceWithContext(ctx, tags)
+	if err != nil {
+		logrus.Warnf("%s: could not tag health check %s: %v", r.GetName(), id, err)
+	}
+	return id, nil
+}
+
+// deleteHealthCheck deletes a health check and its children
+func (r *Route53Provider) deleteHealthCheck(ctx context.Context, id string) error {
+	check, err := r.describeHealthCheck(ctx, id)
+	if isNoSuchHealthCheck(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// a child cannot be deleted while the calculated health check refers to it
+	for _, id := range append([]string{id}, check.children...) {
+		params := &awsRoute53.DeleteHealthCheckInput{
+			HealthCheckId: aws.String(id),
+		}
+		_, err := r.client.DeleteHealthCheckWithContext(ctx, params)
+		if err != nil && !isNoSuchHealthCheck(err) {
+			return fmt.Errorf("Route 53 API call has failed: %v", err)
+		}
+		r.healthCheckMutex.Lock()
+		delete(r.healthChecks, id)
+		r.healthCheckMutex.Unlock()
+	}
+	logrus.Infof("%s: deleted health check %s", r.GetName(), id)
+	return nil
+}
+
+// describeHealthCheck returns the settings and endpoints of a health check,
+// they are cached since managed health checks are replaced rather than updated.
+// The first miss lists all the health checks of the account at once.
+func (r *Route53Provider) describeHealthCheck(ctx context.Context, id string) (healthCheck, error) {
+	r.healthCheckMutex.Lock()
+	check, ok := r.healthChecks[id]
+	listed := r.healthChecksListed
+	r.healthCheckMutex.Unlock()
+	if ok {
+		return check, nil
+	}
+	if !listed {
+		if err := r.listHealthChecks(ctx); err != nil {
+			return check, err
+		}
+		r.healthCheckMutex.Lock()
+		check, ok = r.healthChecks[id]
+		r.healthCheckMutex.Unlock()
+		if ok {
+			return check, nil
+		}
+	}
+
+	config, err := r.getHealthCheckConfig(ctx, id)
+	if err != nil {
+		return check, err
+	}
+	if aws.StringValue(config.Type) != "CALCULATED" {
+		check.config = toHealthCheck(config)
+		check.endpoints = []string{healthCheckEndpoint(config)}
+	} else {
+		check.children = aws.StringValueSlice(config.ChildHealthChecks)
+		for _, child := range check.children {
+			childConfig, err := r.getHealthCheckConfig(ctx, child)
+			if err != nil {
+				return check, err
+			}
+			// the children of a managed health check share their settings
+			check.config = toHealthCheck(childConfig)
+			check.endpoints = append(check.endpoints, healthCheckEndpoint(childConfig))
+		}
+	}
+
+	r.healthCheckMutex.Lock()
+	r.healthChecks[id] = check
+	r.healthCheckMutex.Unlock()
+	return check, nil
+}
+
+// listHealthChecks caches the settings and endpoints of every health check of
+// the account
+func (r *Route53Provider) listHealthChecks(ctx context.Context) error {
+	configs := map[string]*awsRoute53.HealthCheckConfig{}
+	params := &awsRoute53.ListHealthChecksInput{MaxItems: aws.String("100")}
+	for {
+		resp, err := r.client.ListHealthChecksWithContext(ctx, params)
+		if err != nil {
+			return fmt.Errorf("Route 53 API call has failed: %v", err)
+		}
+		for _, check := range resp.HealthChecks {
+			configs[aws.StringValue(check.Id)] = check.HealthCheckConfig
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		params.Marker = resp.NextMarker
+	}
+
+	r.healthCheckMutex.Lock()
+	defer r.healthCheckMutex.Unlock()
+	for id, config := range configs {
+		var check healthCheck
+		if aws.StringValue(config.Type) != "CALCULATED" {
+			check.config = toHealthCheck(config)
+			check.endpoints = []string{healthCheckEndpoint(config)}
+			r.healthChecks[id] = check
+			continue
+		}
+		check.children = aws.StringValueSlice(config.ChildHealthChecks)
+		complete := true
+		for _, child := range check.children {
+			childConfig, ok := configs[child]
+			if !ok {
+				complete = false
+				break
+			}
+			check.config = toHealthCheck(childConfig)
+			check.endpoints = append(check.endpoints, healthCheckEndpoint(childConfig))
+		}
+		// a health check created while listing is described on its own
+		if complete {
+			r.healthChecks[id] = check
+		}
+	}
+	r.healthChecksListed = true
+	return nil
+}
+
+func (r *Route53Provider) getHealthCheckConfig(ctx context.Context, id string) (*awsRoute53.HealthCheckConfig, error) {
+	params := &awsRoute53.GetHealthCheckInput{
+		HealthCheckId: aws.String(id),
+	}
+	resp, err := r.client.GetHealthCheckWithContext(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return resp.HealthCheck.HealthCheckConfig, nil
+}
+
+func toHealthCheck(config *awsRoute53.HealthCheckConfig) dns.HealthCheck {
+	return dns.HealthCheck{
+		Protocol:         aws.StringValue(config.Type),
+		Port:             int(aws.Int64Value(config.Port)),
+		Path:             aws.StringValue(config.ResourcePath),
+		Interval:         int(aws.Int64Value(config.RequestInterval)),
+		FailureThreshold: int(aws.Int64Value(config.FailureThreshold)),
+	}
+}
+
+// healthCheckEndpoint returns the IP address checked, or the hostname when
+// checking an alias target
+func healthCheckEndpoint(config *awsRoute53.HealthCheckConfig) string {
+	if config.IPAddress != nil {
+		return aws.StringValue(config.IPAddress)
+	}
+	return aws.StringValue(config.FullyQualifiedDomainName)
+}
+
+func healthCheckKey(record dns.DnsRecord) string {
+	return strings.ToLower(dns.Fqdn(record.Fqdn)) + "/" + record.Type + "/" + record.SetIdentifier
+}
+
+func isNoSuchHealthCheck(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == awsRoute53.ErrCodeNoSuchHealthCheck
+	}
+	return false
+}
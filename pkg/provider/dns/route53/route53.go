@@ -1,233 +1,408 @@
 package route53
 
 import (
+	"bytes"
 	"fmt"
-	"os"
+	"io/ioutil"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	awsRoute53 "github.com/aws/aws-sdk-go/service/route53"
 	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
-	"github.com/juju/ratelimit"
+	"golang.org/x/net/context"
 )
 
-var route53MaxRetries int = 4
+var route53DefaultRegion = "us-east-1"
+
+// ChangeResourceRecordSets accepts at most 1000 changes per batch
+var route53MaxChangesPerBatch int = 1000
 
 type Route53Provider struct {
-	client       *awsRoute53.Route53
-	hostedZoneId string
-	limiter      *ratelimit.Bucket
+	client    *awsRoute53.Route53
+	transport http.RoundTripper
+	cache     *dns.ZoneCache
+	// public and/or private hosted zones of the root domain, public first
+	zones    []hostedZone
+	zoneType string
+	// identifies the region and credential options the client was built with
+	clientKey string
+
+	healthChecks map[string]healthCheck
+	// health check ids of the public record sets as last listed or written,
+	// keyed by healthCheckKey, empty for record sets without one
+	healthCheckIds map[string]string
+	// the health checks of the account have been listed into healthChecks
+	healthChecksListed bool
+	healthCheckMutex   sync.Mutex
 }
 
 func init() {
 	logrus.Info("Registering 'route53' provider")
-	dns.RegisterProvider("route53", &Route53Provider{})
+	dns.RegisterProvider("route53", func() dns.Provider {
+		return &Route53Provider{
+			cache:          dns.NewZoneCache(),
+			healthChecks:   map[string]healthCheck{},
+			healthCheckIds: map[string]string{},
+		}
+	})
 }
 
-func (r *Route53Provider) Init(rootDomainName string) error {
-	var region, accessKey, secretKey string
-	if region = os.Getenv("AWS_REGION"); len(region) == 0 {
-		return fmt.Errorf("AWS_REGION is not set")
-	}
-
-	if accessKey = os.Getenv("AWS_ACCESS_KEY"); len(accessKey) == 0 {
-		return fmt.Errorf("AWS_ACCESS_KEY is not set")
+func (r *Route53Provider) Init(ctx context.Context, rootDomainName string, options dns.Options) error {
+	region, err := r.setClient(options)
+	if err != nil {
+		return err
 	}
 
-	if secretKey = os.Getenv("AWS_SECRET_KEY"); len(secretKey) == 0 {
-		return fmt.Errorf("AWS_SECRET_KEY is not set")
+	if err := r.setHostedZones(ctx, rootDomainName, options); err != nil {
+		return err
 	}
 
-	// Comply with the API's 5 req/s rate limit. If there are other
-	// clients using the same account the AWS SDK will throttle the
-	// requests automatically if the global rate limit is exhausted.
-	r.limiter = ratelimit.NewBucketWithRate(5.0, 1)
+	logrus.Infof("Configured %s with %s hosted zone %s in region %s",
+		r.GetName(), r.zoneType, rootDomainName, region)
 
-	creds := credentials.NewStaticCredentials(accessKey, secretKey, "")
-	config := aws.NewConfig().WithMaxRetries(route53MaxRetries).
-		WithCredentials(creds).
-		WithRegion(region)
+	return nil
+}
 
-	r.client = awsRoute53.New(session.New(config))
+// setClient builds the client for the options and returns the region it uses
+func (r *Route53Provider) setClient(options dns.Options) (string, error) {
+	region := options.Get("AWS_REGION")
+	if len(region) == 0 {
+		// Route 53 is a global service, the region only selects the endpoint
+		region = route53DefaultRegion
+	}
 
-	if err := r.setHostedZone(rootDomainName); err != nil {
-		return err
+	// the client is only rebuilt when the credential options change so
+	// assumed role credentials are reused and refreshed by the SDK
+	if key := clientKey(region, options); r.client == nil || key != r.clientKey {
+		creds, err := newCredentials(region, options)
+		if err != nil {
+			return "", err
+		}
+		// throttled requests are retried by the limiter, which slows down
+		// every call of the account instead of a single request
+		config := aws.NewConfig().WithMaxRetries(0).
+			WithCredentials(creds).
+			WithRegion(region).
+			WithHTTPClient(&http.Client{Transport: r.transport})
+		r.client = awsRoute53.New(session.New(config))
+		r.clientKey = key
 	}
+	return region, nil
+}
 
-	logrus.Infof("Configured %s with hosted zone %s in region %s",
-		r.GetName(), rootDomainName, region)
+func (*Route53Provider) GetName() string {
+	return "Route 53"
+}
 
-	return nil
+// DefaultRateLimit complies with the API limit of 5 requests per second, it is
+// shared by all the clients of the AWS account
+func (*Route53Provider) DefaultRateLimit() dns.RateLimit {
+	return dns.RateLimit{Rate: 5, Burst: 1, MaxRetries: 4}
 }
 
-func (r *Route53Provider) setHostedZone(rootDomainName string) error {
-	if envVal := os.Getenv("ROUTE53_ZONE_ID"); envVal != "" {
-		r.hostedZoneId = strings.TrimSpace(envVal)
-		if err := r.validateHostedZoneId(rootDomainName); err != nil {
-			return err
-		}
-		return nil
+// RetryAfter retries throttled requests, including PriorRequestNotComplete,
+// and unavailable servers. Route 53 throttles with a 400 response whose body
+// has the error code, and does not say how long to wait.
+func (*Route53Provider) RetryAfter(resp *http.Response) (bool, time.Duration) {
+	if resp.StatusCode >= http.StatusInternalServerError || dns.RetryableStatus(resp.StatusCode) {
+		return true, 0
 	}
-
-	r.limiter.Wait(1)
-	params := &awsRoute53.ListHostedZonesByNameInput{
-		DNSName:  aws.String(dns.UnFqdn(rootDomainName)),
-		MaxItems: aws.String("1"),
+	if resp.StatusCode != http.StatusBadRequest {
+		return false, 0
 	}
-	resp, err := r.client.ListHostedZonesByName(params)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("Could not list hosted zones: %v", err)
+		return false, 0
 	}
-
-	if len(resp.HostedZones) == 0 || *resp.HostedZones[0].Name != rootDomainName {
-		return fmt.Errorf("Hosted zone for '%s' not found", rootDomainName)
+	for _, code := range []string{"Throttling", "PriorRequestNotComplete"} {
+		if bytes.Contains(body, []byte("<Code>"+code+"</Code>")) {
+			return true, 0
+		}
 	}
+	return false, 0
+}
 
-	zoneId := *resp.HostedZones[0].Id
-	if strings.HasPrefix(zoneId, "/hostedzone/") {
-		zoneId = strings.TrimPrefix(zoneId, "/hostedzone/")
-	}
+func (r *Route53Provider) SetTransport(transport http.RoundTripper) {
+	r.transport = transport
+}
 
-	r.hostedZoneId = zoneId
-	return nil
+func (r *Route53Provider) HealthCheck(ctx context.Context) error {
+	var params *awsRoute53.GetHostedZoneCountInput
+	_, err := r.client.GetHostedZoneCountWithContext(ctx, params)
+	return err
 }
 
-func (r *Route53Provider) validateHostedZoneId(rootDomainName string) error {
-	r.limiter.Wait(1)
-	params := &awsRoute53.GetHostedZoneInput{
-		Id: aws.String(r.hostedZoneId),
-	}
-	resp, err := r.client.GetHostedZone(params)
+func (r *Route53Provider) AddRecord(ctx context.Context, record dns.DnsRecord) error {
+	return r.ApplyChanges(ctx, dns.Changes{Create: []dns.DnsRecord{record}})
+}
+
+func (r *Route53Provider) UpdateRecord(ctx context.Context, record dns.DnsRecord) error {
+	return r.ApplyChanges(ctx, dns.Changes{Update: []dns.DnsRecord{record}})
+}
+
+func (r *Route53Provider) RemoveRecord(ctx context.Context, record dns.DnsRecord) error {
+	return r.ApplyChanges(ctx, dns.Changes{Delete: []dns.DnsRecord{record}})
+}
+
+// ApplyChanges sends all the changes in as few change batches as possible,
+// each batch is applied atomically by Route 53 to a single hosted zone
+func (r *Route53Provider) ApplyChanges(ctx context.Context, changes dns.Changes) (err error) {
+	defer r.cache.Invalidate(r.cacheKey())
+
+	// health checks are created before the record sets refer to them and
+	// the replaced ones are deleted once nothing refers to them anymore
+	hc, err := r.prepareHealthChecks(ctx, changes)
+	defer func() { r.finishHealthChecks(ctx, changes, hc, err) }()
 	if err != nil {
-		return fmt.Errorf("Could not look up hosted zone ID %s: %v",
-			r.hostedZoneId, err)
+		return err
 	}
 
-	if *resp.HostedZone.Name != rootDomainName {
-		return fmt.Errorf("Hosted zone ID '%s' does not match name '%s'",
-			r.hostedZoneId, rootDomainName)
+	for _, zone := range r.zones {
+		var awsChanges []*awsRoute53.Change
+		for _, record := range changes.Delete {
+			// a deletion has to match the record set exactly, delete what is
+			// in the zone rather than what was requested
+			rrSets, err := r.listRecordSets(ctx, zone, record.Fqdn)
+			if err != nil {
+				return err
+			}
+			for _, rrSet := range rrSets {
+				if aws.StringValue(rrSet.Type) == record.Type &&
+					aws.StringValue(rrSet.SetIdentifier) == record.SetIdentifier {
+					awsChanges = append(awsChanges, &awsRoute53.Change{
+						Action:            aws.String("DELETE"),
+						ResourceRecordSet: rrSet,
+					})
+					if id := aws.StringValue(rrSet.HealthCheckId); len(id) > 0 && !zone.private {
+						hc.stale = append(hc.stale, id)
+					}
+				}
+			}
+		}
+		for _, record := range append(append([]dns.DnsRecord{}, changes.Update...), changes.Create...) {
+			change := newChange("UPSERT", record, zone.values(record))
+			if id := hc.ids[healthCheckKey(record)]; len(id) > 0 && !zone.private {
+				change.ResourceRecordSet.HealthCheckId = aws.String(id)
+			}
+			awsChanges = append(awsChanges, change)
+		}
+
+		if err := r.changeRecordSets(ctx, zone, awsChanges); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (*Route53Provider) GetName() string {
-	return "Route 53"
+func (r *Route53Provider) changeRecordSets(ctx context.Context, zone hostedZone, awsChanges []*awsRoute53.Change) error {
+	for len(awsChanges) > 0 {
+		batch := awsChanges
+		if len(batch) > route53MaxChangesPerBatch {
+			batch = batch[:route53MaxChangesPerBatch]
+		}
+		awsChanges = awsChanges[len(batch):]
+
+		params := &awsRoute53.ChangeResourceRecordSetsInput{
+			HostedZoneId: aws.String(zone.id),
+			ChangeBatch: &awsRoute53.ChangeBatch{
+				Comment: aws.String("Managed by Rancher"),
+				Changes: batch,
+			},
+		}
+		_, err := r.client.ChangeResourceRecordSetsWithContext(ctx, params)
+		if err != nil {
+			return fmt.Errorf("Route 53 API call has failed: %v", err)
+		}
+		logrus.Debugf("Applied a batch of %d changes to hosted zone %s", len(batch), zone.id)
+	}
+	return nil
 }
 
-func (r *Route53Provider) HealthCheck() error {
-	var params *awsRoute53.GetHostedZoneCountInput
-	_, err := r.client.GetHostedZoneCount(params)
-	return err
+func newChange(action string, record dns.DnsRecord, values []string) *awsRoute53.Change {
+	records := make([]*awsRoute53.ResourceRecord, len(values))
+	for idx, value := range values {
+		records[idx] = &awsRoute53.ResourceRecord{
+			Value: aws.String(route53Value(record.Type, value)),
+		}
+	}
+
+	rrSet := &awsRoute53.ResourceRecordSet{
+		Name:            aws.String(record.Fqdn),
+		Type:            aws.String(record.Type),
+		TTL:             aws.Int64(int64(record.TTL)),
+		ResourceRecords: records,
+	}
+	setRoutingPolicy(rrSet, record)
+	// private zones of a split-horizon record may get IPs instead
+	if record.Alias && len(values) > 0 && len(canonicalHostedZone(values[0])) > 0 {
+		setAliasTarget(rrSet, values[0])
+	}
+
+	return &awsRoute53.Change{
+		Action:            aws.String(action),
+		ResourceRecordSet: rrSet,
+	}
 }
 
-func (r *Route53Provider) AddRecord(record dns.DnsRecord) error {
-	return r.changeRecord(record, "UPSERT")
+// GetRecords returns the records of the selected hosted zones, listed at most
+// once per dns.ZoneCacheTTL
+func (r *Route53Provider) GetRecords(ctx context.Context) ([]dns.DnsRecord, error) {
+	return r.cache.Records(ctx, r.cacheKey(), r.listRecords)
 }
 
-func (r *Route53Provider) UpdateRecord(record dns.DnsRecord) error {
-	return r.changeRecord(record, "UPSERT")
+func (r *Route53Provider) listRecords(ctx context.Context) ([]dns.DnsRecord, error) {
+	zoneRecords := map[string][]dns.DnsRecord{}
+	for _, zone := range r.zones {
+		var rrSets []*awsRoute53.ResourceRecordSet
+		params := &awsRoute53.ListResourceRecordSetsInput{
+			HostedZoneId: aws.String(zone.id),
+			MaxItems:     aws.String("100"),
+		}
+
+		err := r.listPages(ctx, params, func(page []*awsRoute53.ResourceRecordSet) bool {
+			rrSets = append(rrSets, page...)
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Route 53 API call has failed: %v", err)
+		}
+		r.setHealthCheckIds(zone, "", rrSets)
+		if zoneRecords[zone.id], err = r.toDnsRecords(ctx, rrSets); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.mergeZoneRecords(zoneRecords), nil
 }
 
-func (r *Route53Provider) RemoveRecord(record dns.DnsRecord) error {
-	return r.changeRecord(record, "DELETE")
+// GetRecord uses the cached zones if they are fresh, otherwise only the record
+// sets of the fqdn are listed
+func (r *Route53Provider) GetRecord(ctx context.Context, fqdn, recordType string) (*dns.DnsRecord, error) {
+	records, ok := r.cache.Fresh(r.cacheKey())
+	if !ok {
+		var err error
+		if records, err = r.listRecordsByName(ctx, fqdn); err != nil {
+			return nil, err
+		}
+	}
+	return dns.FindRecord(records, fqdn, recordType), nil
 }
 
-func (r *Route53Provider) changeRecord(record dns.DnsRecord, action string) error {
-	r.limiter.Wait(1)
-	records := make([]*awsRoute53.ResourceRecord, len(record.Records))
-	for idx, value := range record.Records {
-		if record.Type == "TXT" {
-			value = `"` + value + `"`
+// GetRecordSets returns all the record sets with the fqdn, one per set identifier
+func (r *Route53Provider) GetRecordSets(ctx context.Context, fqdn string) ([]dns.DnsRecord, error) {
+	records, ok := r.cache.Fresh(r.cacheKey())
+	if !ok {
+		var err error
+		if records, err = r.listRecordsByName(ctx, fqdn); err != nil {
+			return nil, err
 		}
-		records[idx] = &awsRoute53.ResourceRecord{
-			Value: aws.String(value),
-		}
-	}
-
-	params := &awsRoute53.ChangeResourceRecordSetsInput{
-		HostedZoneId: aws.String(r.hostedZoneId),
-		ChangeBatch: &awsRoute53.ChangeBatch{
-			Comment: aws.String("Managed by Rancher"),
-			Changes: []*awsRoute53.Change{
-				{
-					Action: aws.String(action),
-					ResourceRecordSet: &awsRoute53.ResourceRecordSet{
-						Name:            aws.String(record.Fqdn),
-						Type:            aws.String(record.Type),
-						TTL:             aws.Int64(int64(record.TTL)),
-						ResourceRecords: records,
-					},
-				},
-			},
-		},
 	}
 
-	_, err := r.client.ChangeResourceRecordSets(params)
-	return err
+	var recordSets []dns.DnsRecord
+	for _, record := range records {
+		if dns.SameName(record.Fqdn, fqdn) {
+			recordSets = append(recordSets, record)
+		}
+	}
+	return recordSets, nil
 }
 
-func (r *Route53Provider) GetRecords() ([]dns.DnsRecord, error) {
-	r.limiter.Wait(1)
-	dnsRecords := []dns.DnsRecord{}
-	rrSets := []*awsRoute53.ResourceRecordSet{}
+// listRecordsByName returns the records of the selected zones with the fqdn
+func (r *Route53Provider) listRecordsByName(ctx context.Context, fqdn string) ([]dns.DnsRecord, error) {
+	zoneRecords := map[string][]dns.DnsRecord{}
+	for _, zone := range r.zones {
+		rrSets, err := r.listRecordSets(ctx, zone, fqdn)
+		if err != nil {
+			return nil, err
+		}
+		r.setHealthCheckIds(zone, fqdn, rrSets)
+		if zoneRecords[zone.id], err = r.toDnsRecords(ctx, rrSets); err != nil {
+			return nil, err
+		}
+	}
+	return r.mergeZoneRecords(zoneRecords), nil
+}
+
+// listRecordSets returns the record sets of the zone with the fqdn
+func (r *Route53Provider) listRecordSets(ctx context.Context, zone hostedZone, fqdn string) ([]*awsRoute53.ResourceRecordSet, error) {
+	// record sets are returned sorted by name, the first ones are the record
+	// sets of the fqdn if it exists, stop at the first one with another name
 	params := &awsRoute53.ListResourceRecordSetsInput{
-		HostedZoneId: aws.String(r.hostedZoneId),
-		MaxItems:     aws.String("100"),
+		HostedZoneId:    aws.String(zone.id),
+		StartRecordName: aws.String(dns.Fqdn(fqdn)),
+		MaxItems:        aws.String("10"),
 	}
 
-	err := r.client.ListResourceRecordSetsPages(params,
-		func(page *awsRoute53.ListResourceRecordSetsOutput, lastPage bool) bool {
-			rrSets = append(rrSets, page.ResourceRecordSets...)
-			return !lastPage
-		})
+	var rrSets []*awsRoute53.ResourceRecordSet
+	err := r.listPages(ctx, params, func(page []*awsRoute53.ResourceRecordSet) bool {
+		for _, rrSet := range page {
+			if !dns.SameName(aws.StringValue(rrSet.Name), fqdn) {
+				return false
+			}
+			rrSets = append(rrSets, rrSet)
+		}
+		return true
+	})
 	if err != nil {
-		return dnsRecords, fmt.Errorf("Route 53 API call has failed: %v", err)
+		return nil, fmt.Errorf("Route 53 API call has failed: %v", err)
+	}
+	return rrSets, nil
+}
+
+// listPages requests the record sets one page at a time, until add returns
+// false or there are no more pages
+func (r *Route53Provider) listPages(ctx context.Context, params *awsRoute53.ListResourceRecordSetsInput, add func([]*awsRoute53.ResourceRecordSet) bool) error {
+	for {
+		resp, err := r.client.ListResourceRecordSetsWithContext(ctx, params)
+		if err != nil {
+			return err
+		}
+		if !add(resp.ResourceRecordSets) || !aws.BoolValue(resp.IsTruncated) {
+			return nil
+		}
+		params.StartRecordName = resp.NextRecordName
+		params.StartRecordType = resp.NextRecordType
+		params.StartRecordIdentifier = resp.NextRecordIdentifier
 	}
+}
 
+func (r *Route53Provider) toDnsRecords(ctx context.Context, rrSets []*awsRoute53.ResourceRecordSet) ([]dns.DnsRecord, error) {
+	dnsRecords := []dns.DnsRecord{}
 	for _, rrSet := range rrSets {
-		// skip proprietary Route 53 alias resource record sets
+		records := []string{}
 		if rrSet.AliasTarget != nil {
-			logrus.Debug("Skipped Route53 alias RRset")
-			continue
+			records = append(records, strings.ToLower(aws.StringValue(rrSet.AliasTarget.DNSName)))
 		}
-		records := []string{}
 		for _, rr := range rrSet.ResourceRecords {
-			value := *rr.Value
-			if *rrSet.Type == "TXT" {
-				value = strings.Trim(value, `"`)
-			}
-			records = append(records, value)
+			records = append(records, recordValue(aws.StringValue(rrSet.Type), aws.StringValue(rr.Value)))
 		}
 
 		dnsRecord := dns.DnsRecord{
 			Fqdn:    *rrSet.Name,
 			Records: records,
 			Type:    *rrSet.Type,
-			TTL:     int(*rrSet.TTL),
+			TTL:     int(aws.Int64Value(rrSet.TTL)),
+			Alias:   rrSet.AliasTarget != nil,
+
+			SetIdentifier: aws.StringValue(rrSet.SetIdentifier),
+			Routing:       getRoutingPolicy(rrSet),
+		}
+		if id := aws.StringValue(rrSet.HealthCheckId); len(id) > 0 {
+			check, err := r.describeHealthCheck(ctx, id)
+			if err != nil && !isNoSuchHealthCheck(err) {
+				return nil, fmt.Errorf("Route 53 API call has failed: %v", err)
+			}
+			dnsRecord.HealthCheck = check.config
 		}
 		dnsRecords = append(dnsRecords, dnsRecord)
 	}
-
 	return dnsRecords, nil
 }
-
-func (c *Route53Provider) GetRecord(fqdn string) (*dns.DnsRecord, error) {
-	records, err := c.GetRecords()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, r := range records {
-		// need to sanitize
-		if r.Fqdn == dns.Fqdn(fqdn) {
-			logrus.Info(r)
-			return &r, nil
-		}
-	}
-
-	return nil, nil
-}
@@ -0,0 +1,62 @@
+package route53
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	awsRoute53 "github.com/aws/aws-sdk-go/service/route53"
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// setRoutingPolicy sets the set identifier and the routing policy fields of
+// the record set, a simple record set has neither
+func setRoutingPolicy(rrSet *awsRoute53.ResourceRecordSet, record dns.DnsRecord) {
+	if len(record.SetIdentifier) == 0 {
+		return
+	}
+	rrSet.SetIdentifier = aws.String(record.SetIdentifier)
+
+	policy := record.Routing
+	switch policy.Type {
+	case dns.RoutingWeighted:
+		rrSet.Weight = aws.Int64(policy.Weight)
+	case dns.RoutingLatency:
+		rrSet.Region = aws.String(policy.Region)
+	case dns.RoutingGeolocation:
+		location := &awsRoute53.GeoLocation{}
+		if len(policy.Continent) > 0 {
+			location.ContinentCode = aws.String(policy.Continent)
+		}
+		if len(policy.Country) > 0 {
+			location.CountryCode = aws.String(policy.Country)
+		}
+		if len(policy.Subdivision) > 0 {
+			location.SubdivisionCode = aws.String(policy.Subdivision)
+		}
+		rrSet.GeoLocation = location
+	case dns.RoutingFailover:
+		rrSet.Failover = aws.String(policy.Failover)
+	case dns.RoutingMultiValue:
+		rrSet.MultiValueAnswer = aws.Bool(true)
+	}
+}
+
+// getRoutingPolicy returns the routing policy of the record set
+func getRoutingPolicy(rrSet *awsRoute53.ResourceRecordSet) dns.RoutingPolicy {
+	switch {
+	case rrSet.Weight != nil:
+		return dns.RoutingPolicy{Type: dns.RoutingWeighted, Weight: aws.Int64Value(rrSet.Weight)}
+	case rrSet.Region != nil:
+		return dns.RoutingPolicy{Type: dns.RoutingLatency, Region: aws.StringValue(rrSet.Region)}
+	case rrSet.GeoLocation != nil:
+		return dns.RoutingPolicy{
+			Type:        dns.RoutingGeolocation,
+			Continent:   aws.StringValue(rrSet.GeoLocation.ContinentCode),
+			Country:     aws.StringValue(rrSet.GeoLocation.CountryCode),
+			Subdivision: aws.StringValue(rrSet.GeoLocation.SubdivisionCode),
+		}
+	case rrSet.Failover != nil:
+		return dns.RoutingPolicy{Type: dns.RoutingFailover, Failover: aws.StringValue(rrSet.Failover)}
+	case aws.BoolValue(rrSet.MultiValueAnswer):
+		return dns.RoutingPolicy{Type: dns.RoutingMultiValue}
+	}
+	return dns.RoutingPolicy{}
+}
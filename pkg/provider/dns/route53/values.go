@@ -0,0 +1,76 @@
+package route53
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+)
+
+// a TXT character string holds at most 255 characters, longer texts are split
+// in several strings which resolvers join back
+const txtMaxLength = 255
+
+// route53Value returns the value in the format of the API, which uses the
+// presentation format except for the quoted TXT strings
+func route53Value(recordType, value string) string {
+	if recordType == dns.TypeTXT {
+		return quoteTXT(value)
+	}
+	return value
+}
+
+// recordValue returns the value of a resource record as it is written
+func recordValue(recordType, value string) string {
+	switch recordType {
+	case "A", "AAAA":
+		return value
+	case dns.TypeTXT:
+		return unquoteTXT(value)
+	}
+	return dns.CanonicalRecordValue(recordType, value)
+}
+
+func quoteTXT(text string) string {
+	var parts []string
+	for {
+		part := text
+		if len(part) > txtMaxLength {
+			part = part[:txtMaxLength]
+		}
+		text = text[len(part):]
+		part = strings.Replace(part, `\`, `\\`, -1)
+		part = strings.Replace(part, `"`, `\"`, -1)
+		parts = append(parts, `"`+part+`"`)
+		if len(text) == 0 {
+			return strings.Join(parts, " ")
+		}
+	}
+}
+
+// unquoteTXT joins the strings of a TXT value, Route 53 escapes characters
+// that are not printable as \ddd
+func unquoteTXT(value string) string {
+	var text []byte
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(value):
+			i++
+			if i+2 < len(value) {
+				if n, err := strconv.ParseUint(value[i:i+3], 10, 8); err == nil {
+					text = append(text, byte(n))
+					i += 2
+					continue
+				}
+			}
+			text = append(text, value[i])
+		case quoted:
+			text = append(text, c)
+		}
+	}
+	return string(text)
+}
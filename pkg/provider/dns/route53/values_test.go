@@ -0,0 +1,85 @@
+package route53
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	awsRoute53 "github.com/aws/aws-sdk-go/service/route53"
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+	"golang.org/x/net/context"
+)
+
+func TestValueRoundTrip(t *testing.T) {
+	tests := []struct {
+		recordType string
+		value      string
+		native     string
+	}{
+		{"A", "192.0.2.1", "192.0.2.1"},
+		{dns.TypeCNAME, "www.example.com.", "www.example.com."},
+		{dns.TypeTXT, "v=spf1 include:_spf.example.com ~all", `"v=spf1 include:_spf.example.com ~all"`},
+		{dns.TypeTXT, `say "hello" \ bye`, `"say \"hello\" \\ bye"`},
+		{dns.TypeMX, "10 mail.example.com.", "10 mail.example.com."},
+		{dns.TypeSRV, "10 5 443 api.example.com.", "10 5 443 api.example.com."},
+		{dns.TypeCAA, `0 issue "letsencrypt.org"`, `0 issue "letsencrypt.org"`},
+		{dns.TypeNS, "ns1.example.com.", "ns1.example.com."},
+	}
+
+	for _, test := range tests {
+		native := route53Value(test.recordType, test.value)
+		if native != test.native {
+			t.Errorf("%s %q: got %q, want %q", test.recordType, test.value, native, test.native)
+		}
+		if value := recordValue(test.recordType, native); value != test.value {
+			t.Errorf("%s %q: read back as %q", test.recordType, test.value, value)
+		}
+	}
+}
+
+func TestCAAWhitespace(t *testing.T) {
+	for _, value := range []string{`0  issue "letsencrypt.org"`, "0\tissue\t\"letsencrypt.org\""} {
+		if read := recordValue(dns.TypeCAA, value); read != `0 issue "letsencrypt.org"` {
+			t.Errorf("%q: read back as %q", value, read)
+		}
+	}
+}
+
+func TestLongTXTRoundTrip(t *testing.T) {
+	text := strings.Repeat("a", txtMaxLength) + strings.Repeat("b", 10)
+	native := route53Value(dns.TypeTXT, text)
+	if want := `"` + strings.Repeat("a", txtMaxLength) + `" "bbbbbbbbbb"`; native != want {
+		t.Errorf("got %q, want %q", native, want)
+	}
+	if value := recordValue(dns.TypeTXT, native); value != text {
+		t.Errorf("read back as %q", value)
+	}
+}
+
+func TestRecordSetRoundTrip(t *testing.T) {
+	records := []dns.DnsRecord{
+		{Fqdn: "www.example.com.", Type: "A", TTL: 300, Records: []string{"192.0.2.1", "192.0.2.2"}},
+		{Fqdn: "example.com.", Type: dns.TypeTXT, TTL: 60, Records: []string{"v=spf1 -all", `quoted "text"`}},
+		{Fqdn: "example.com.", Type: dns.TypeMX, TTL: 3600, Records: []string{"10 mail.example.com.", "20 backup.example.com."}},
+		{Fqdn: "_https._tcp.example.com.", Type: dns.TypeSRV, TTL: 300, Records: []string{"10 5 443 api.example.com."}},
+		{Fqdn: "example.com.", Type: dns.TypeCAA, TTL: 300, Records: []string{`0 issue "letsencrypt.org"`}},
+		{Fqdn: "sub.example.com.", Type: dns.TypeNS, TTL: 172800, Records: []string{"ns1.example.com.", "ns2.example.com."}},
+		{
+			Fqdn: "api.example.com.", Type: "A", TTL: 60, Records: []string{"192.0.2.3"},
+			SetIdentifier: "blue", Routing: dns.RoutingPolicy{Type: dns.RoutingWeighted, Weight: 10},
+		},
+	}
+
+	r := &Route53Provider{}
+	for _, record := range records {
+		rrSet := newChange("UPSERT", record, record.Records).ResourceRecordSet
+		read, err := r.toDnsRecords(context.Background(), []*awsRoute53.ResourceRecordSet{rrSet})
+		if err != nil {
+			t.Errorf("%s %s: %v", record.Fqdn, record.Type, err)
+			continue
+		}
+		if len(read) != 1 || !reflect.DeepEqual(read[0], record) {
+			t.Errorf("%s %s: read back as %+v, want %+v", record.Fqdn, record.Type, read, record)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package route53
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsRoute53 "github.com/aws/aws-sdk-go/service/route53"
+	"github.com/dkoshkin/kube-external-dns/pkg/provider/dns"
+	"golang.org/x/net/context"
+)
+
+// Hosted zone types selected with ROUTE53_ZONE_TYPE
+const (
+	zoneTypePublic  = "public"
+	zoneTypePrivate = "private"
+	zoneTypeBoth    = "both"
+)
+
+type hostedZone struct {
+	id      string
+	private bool
+}
+
+// setHostedZones selects the public and/or private hosted zone of the root
+// domain. Private zones can be narrowed down to the ones associated with
+// ROUTE53_VPC_ID, or any zone can be picked explicitly with ROUTE53_ZONE_ID
+// which takes a comma separated list of IDs.
+func (r *Route53Provider) setHostedZones(ctx context.Context, rootDomainName string, options dns.Options) error {
+	zoneType := strings.ToLower(options.Get("ROUTE53_ZONE_TYPE"))
+	if len(zoneType) == 0 {
+		zoneType = zoneTypePublic
+	}
+	if zoneType != zoneTypePublic && zoneType != zoneTypePrivate && zoneType != zoneTypeBoth {
+		return fmt.Errorf("ROUTE53_ZONE_TYPE must be one of '%s', '%s' or '%s', got '%s'",
+			zoneTypePublic, zoneTypePrivate, zoneTypeBoth, zoneType)
+	}
+	vpcID := options.Get("ROUTE53_VPC_ID")
+
+	var candidates []hostedZone
+	if ids := options.Get("ROUTE53_ZONE_ID"); len(ids) > 0 {
+		for _, id := range strings.Split(ids, ",") {
+			zone, _, err := r.getHostedZone(ctx, strings.TrimSpace(id), rootDomainName)
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, zone)
+		}
+	} else {
+		var err error
+		if candidates, err = r.listHostedZones(ctx, rootDomainName); err != nil {
+			return err
+		}
+	}
+
+	var public, private []hostedZone
+	for _, zone := range candidates {
+		if !zone.private {
+			if zoneType != zoneTypePrivate {
+				public = append(public, zone)
+			}
+			continue
+		}
+		if zoneType == zoneTypePublic {
+			continue
+		}
+		if len(vpcID) > 0 {
+			inVPC, err := r.zoneInVPC(ctx, zone.id, rootDomainName, vpcID, options.Get("ROUTE53_VPC_REGION"))
+			if err != nil {
+				return err
+			}
+			if !inVPC {
+				continue
+			}
+		}
+		private = append(private, zone)
+	}
+
+	if len(public) > 1 {
+		return fmt.Errorf("Found %d public hosted zones for '%s', set ROUTE53_ZONE_ID", len(public), rootDomainName)
+	}
+	if len(private) > 1 {
+		return fmt.Errorf("Found %d private hosted zones for '%s', set ROUTE53_VPC_ID or ROUTE53_ZONE_ID", len(private), rootDomainName)
+	}
+	if zoneType != zoneTypePrivate && len(public) == 0 {
+		return fmt.Errorf("Public hosted zone for '%s' not found", rootDomainName)
+	}
+	if zoneType != zoneTypePublic && len(private) == 0 {
+		return fmt.Errorf("Private hosted zone for '%s' not found", rootDomainName)
+	}
+
+	r.zoneType = zoneType
+	r.zones = append(public, private...)
+	return nil
+}
+
+// ListZones returns the names of all the hosted zones of the account
+func (r *Route53Provider) ListZones(ctx context.Context, options dns.Options) ([]string, error) {
+	if _, err := r.setClient(options); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	params := &awsRoute53.ListHostedZonesInput{}
+	for {
+		resp, err := r.client.ListHostedZonesWithContext(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("Could not list hosted zones: %v", err)
+		}
+		// public and private zones can share a name
+		for _, zone := range resp.HostedZones {
+			name := dns.UnFqdn(aws.StringValue(zone.Name))
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			return names, nil
+		}
+		params.Marker = resp.NextMarker
+	}
+}
+
+// listHostedZones returns all the hosted zones with the root domain name
+func (r *Route53Provider) listHostedZones(ctx context.Context, rootDomainName string) ([]hostedZone, error) {
+	var zones []hostedZone
+	name := dns.Fqdn(rootDomainName)
+	params := &awsRoute53.ListHostedZonesByNameInput{
+		DNSName:  aws.String(dns.UnFqdn(rootDomainName)),
+		MaxItems: aws.String("100"),
+	}
+	for {
+		resp, err := r.client.ListHostedZonesByNameWithContext(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("Could not list hosted zones: %v", err)
+		}
+		// zones are sorted by name, stop at the first one with another name
+		for _, zone := range resp.HostedZones {
+			if aws.StringValue(zone.Name) != name {
+				return zones, nil
+			}
+			zones = append(zones, hostedZone{
+				id:      trimZoneId(aws.StringValue(zone.Id)),
+				private: zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone),
+			})
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			return zones, nil
+		}
+		params.DNSName = resp.NextDNSName
+		params.HostedZoneId = resp.NextHostedZoneId
+	}
+}
+
+// getHostedZone looks up a zone by ID and checks it belongs to the root domain
+func (r *Route53Provider) getHostedZone(ctx context.Context, id, rootDomainName string) (hostedZone, []*awsRoute53.VPC, error) {
+	params := &awsRoute53.GetHostedZoneInput{
+		Id: aws.String(id),
+	}
+	resp, err := r.client.GetHostedZoneWithContext(ctx, params)
+	if err != nil {
+		return hostedZone{}, nil, fmt.Errorf("Could not look up hosted zone ID %s: %v", id, err)
+	}
+
+	if !dns.SameName(aws.StringValue(resp.HostedZone.Name), rootDomainName) {
+		return hostedZone{}, nil, fmt.Errorf("Hosted zone ID '%s' does not match name '%s'", id, rootDomainName)
+	}
+
+	zone := hostedZone{
+		id:      trimZoneId(aws.StringValue(resp.HostedZone.Id)),
+		private: resp.HostedZone.Config != nil && aws.BoolValue(resp.HostedZone.Config.PrivateZone),
+	}
+	return zone, resp.VPCs, nil
+}
+
+// zoneInVPC returns true if the private zone is associated with the VPC, the
+// region is only compared when set
+func (r *Route53Provider) zoneInVPC(ctx context.Context, id, rootDomainName, vpcID, vpcRegion string) (bool, error) {
+	_, vpcs, err := r.getHostedZone(ctx, id, rootDomainName)
+	if err != nil {
+		return false, err
+	}
+	for _, vpc := range vpcs {
+		if aws.StringValue(vpc.VPCId) != vpcID {
+			continue
+		}
+		if len(vpcRegion) == 0 || aws.StringValue(vpc.VPCRegion) == vpcRegion {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// values returns the record values written to the zone
+func (z hostedZone) values(record dns.DnsRecord) []string {
+	if z.private && len(record.PrivateRecords) > 0 {
+		return record.PrivateRecords
+	}
+	return record.Records
+}
+
+// mergeZoneRecords combines the records of the selected zones into one list,
+// when both a public and a private zone are selected the values of the
+// private zone are returned as PrivateRecords
+func (r *Route53Provider) mergeZoneRecords(zoneRecords map[string][]dns.DnsRecord) []dns.DnsRecord {
+	merged := []dns.DnsRecord{}
+	index := map[string]int{}
+	for _, zone := range r.zones {
+		for _, record := range zoneRecords[zone.id] {
+			key := record.Fqdn + "/" + record.Type + "/" + record.SetIdentifier
+			i, exists := index[key]
+			splitHorizon := zone.private && r.zoneType == zoneTypeBoth
+			switch {
+			case !exists && splitHorizon:
+				record.PrivateRecords = record.Records
+				record.Records = nil
+			case exists && splitHorizon:
+				merged[i].PrivateRecords = record.Records
+				continue
+			case exists:
+				merged[i].Records = record.Records
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, record)
+		}
+	}
+	return merged
+}
+
+// Normalize returns the record as GetRecords returns it once written to the
+// selected zones
+func (r *Route53Provider) Normalize(record dns.DnsRecord) dns.DnsRecord {
+	record = normalizeAlias(record)
+	switch r.zoneType {
+	case zoneTypePrivate:
+		if len(record.PrivateRecords) > 0 {
+			record.Records = record.PrivateRecords
+		}
+		record.PrivateRecords = nil
+		// private IPs cannot be health checked
+		record.HealthCheck = dns.HealthCheck{}
+	case zoneTypePublic:
+		record.PrivateRecords = nil
+	default:
+		if len(record.PrivateRecords) == 0 {
+			record.PrivateRecords = record.Records
+		}
+	}
+	return record
+}
+
+// cacheKey identifies the selected zones in the zone cache
+func (r *Route53Provider) cacheKey() string {
+	ids := make([]string, len(r.zones))
+	for i, zone := range r.zones {
+		ids[i] = zone.id
+	}
+	return strings.Join(ids, ",")
+}
+
+func trimZoneId(zoneId string) string {
+	return strings.TrimPrefix(zoneId, "/hostedzone/")
+}
@@ -0,0 +1,53 @@
+package dns
+
+import (
+	"golang.org/x/net/context"
+)
+
+// Routing policy types, an empty type is a simple record set
+const (
+	RoutingWeighted    = "weighted"
+	RoutingLatency     = "latency"
+	RoutingGeolocation = "geolocation"
+	RoutingFailover    = "failover"
+	RoutingMultiValue  = "multivalue"
+)
+
+// RoutingPolicy decides which of the record sets sharing a name is returned
+// to a client, only the fields of its Type are used
+type RoutingPolicy struct {
+	Type string
+	// weighted
+	Weight int64
+	// latency
+	Region string
+	// geolocation, Country "*" is the default location
+	Continent   string
+	Country     string
+	Subdivision string
+	// failover, "PRIMARY" or "SECONDARY"
+	Failover string
+}
+
+// RecordSetProvider is implemented by providers that keep several record
+// sets under one name told apart by their SetIdentifier
+type RecordSetProvider interface {
+	GetRecordSets(ctx context.Context, fqdn string) ([]DnsRecord, error)
+}
+
+// GetRecordSet returns the record set of the provider with the fqdn and set
+// identifier of the record, or nil if there is none
+func GetRecordSet(ctx context.Context, provider Provider, record DnsRecord) (*DnsRecord, error) {
+	if len(record.SetIdentifier) == 0 {
+		return provider.GetRecord(ctx, record.Fqdn, record.Type)
+	}
+	setProvider, ok := provider.(RecordSetProvider)
+	if !ok {
+		return nil, nil
+	}
+	records, err := setProvider.GetRecordSets(ctx, record.Fqdn)
+	if err != nil {
+		return nil, err
+	}
+	return FindRecordSet(records, record.Fqdn, record.Type, record.SetIdentifier), nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// the AdmissionReview of admission.k8s.io v1 and v1beta1, only the fields used
+// by the webhook
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string          `json:"uid"`
+	Namespace string          `json:"namespace"`
+	Operation string          `json:"operation"`
+	Object    json.RawMessage `json:"object"`
+}
+
+type admissionResponse struct {
+	UID     string           `json:"uid"`
+	Allowed bool             `json:"allowed"`
+	Status  *admissionStatus `json:"status,omitempty"`
+}
+
+type admissionStatus struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// AdmissionHandler answers the AdmissionReview requests of a validating
+// webhook for services, a service is rejected with the error of validate
+func AdmissionHandler(validate func(*v1.Service) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var review admissionReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			http.Error(w, fmt.Sprintf("invalid AdmissionReview: %v", err), http.StatusBadRequest)
+			return
+		}
+		if review.Request == nil {
+			http.Error(w, "AdmissionReview without a request", http.StatusBadRequest)
+			return
+		}
+		request := review.Request
+		response := &admissionResponse{UID: request.UID, Allowed: true}
+
+		// deletions do not have an object
+		if len(request.Object) > 0 && string(request.Object) != "null" {
+			service := &v1.Service{}
+			if err := json.Unmarshal(request.Object, service); err != nil {
+				http.Error(w, fmt.Sprintf("invalid service: %v", err), http.StatusBadRequest)
+				return
+			}
+			if service.Namespace == "" {
+				service.Namespace = request.Namespace
+			}
+			if err := validate(service); err != nil {
+				logrus.Infof("%s: service rejected on %s: %v", service.Name, request.Operation, err)
+				response.Allowed = false
+				response.Status = &admissionStatus{Message: err.Error(), Code: http.StatusForbidden}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(admissionReview{
+			APIVersion: review.APIVersion,
+			Kind:       review.Kind,
+			Response:   response,
+		})
+	})
+}
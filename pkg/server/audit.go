@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dkoshkin/kube-external-dns/pkg/audit"
+)
+
+// default number of entries returned by the audit handler
+const defaultAuditLimit = 100
+
+// AuditHandler returns the entries of the audit log as a JSON list, filtered
+// with the fqdn, zone, provider, namespace, name, since, until and limit query
+// parameters, e.g. /audit?fqdn=api.koshk.in&since=2017-06-01T00:00:00Z
+func AuditHandler(log *audit.Log) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		q := audit.Query{
+			FQDN:      params.Get("fqdn"),
+			Zone:      params.Get("zone"),
+			Provider:  params.Get("provider"),
+			Namespace: params.Get("namespace"),
+			Name:      params.Get("name"),
+			Limit:     defaultAuditLimit,
+		}
+		var err error
+		if q.Since, err = parseTime(params.Get("since")); err != nil {
+			http.Error(w, fmt.Sprintf("invalid since: %v", err), http.StatusBadRequest)
+			return
+		}
+		if q.Until, err = parseTime(params.Get("until")); err != nil {
+			http.Error(w, fmt.Sprintf("invalid until: %v", err), http.StatusBadRequest)
+			return
+		}
+		if limit := params.Get("limit"); limit != "" {
+			if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+				http.Error(w, fmt.Sprintf("invalid limit '%s'", limit), http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries, err := log.Find(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if entries == nil {
+			entries = []audit.Entry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
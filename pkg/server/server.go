@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var binaryVersion string
@@ -16,6 +17,7 @@ func NewRouter(version, buildDate string) *mux.Router {
 
 	r := mux.NewRouter()
 	r.HandleFunc("/healthz", HealthzHandler)
+	r.Handle("/metrics", promhttp.Handler())
 	return r
 }
 
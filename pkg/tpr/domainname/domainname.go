@@ -17,13 +17,57 @@ type Record struct {
 	Endpoints []string `json:"endpoints"`
 	Type      string   `json:"type"`
 	TTL       int      `json:"ttl"`
+	// endpoints of the record in private zones, when they differ
+	PrivateEndpoints []string `json:"privateEndpoints,omitempty"`
+	// identifies the record set among the ones sharing the fqdn
+	SetIdentifier string `json:"setIdentifier,omitempty"`
+}
+
+// DomainNameStatus has the sync status of the record in each of its providers
+type DomainNameStatus struct {
+	Providers []ProviderStatus `json:"providers,omitempty"`
+}
+
+type ProviderStatus struct {
+	Name   string `json:"name"`
+	Synced bool   `json:"synced"`
+	// last error returned by the provider, empty once synced
+	Error              string      `json:"error,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
 }
 
 type DomainName struct {
 	metav1.TypeMeta `json:",inline"`
 	Metadata        metav1.ObjectMeta `json:"metadata"`
 
-	Spec DomainNameSpec `json:"spec"`
+	Spec   DomainNameSpec   `json:"spec"`
+	Status DomainNameStatus `json:"status,omitempty"`
+}
+
+// SetProviderStatus records the outcome of the last sync with the provider,
+// the transition time only moves when the status changes
+func (s *DomainNameStatus) SetProviderStatus(name string, synced bool, errMsg string) {
+	for i, p := range s.Providers {
+		if p.Name != name {
+			continue
+		}
+		if p.Synced != synced || p.Error != errMsg {
+			s.Providers[i] = ProviderStatus{Name: name, Synced: synced, Error: errMsg, LastTransitionTime: metav1.Now()}
+		}
+		return
+	}
+	s.Providers = append(s.Providers, ProviderStatus{Name: name, Synced: synced, Error: errMsg, LastTransitionTime: metav1.Now()})
+}
+
+// GetProviderStatus returns the status of the provider, or nil if the record
+// has never been synced with it
+func (s *DomainNameStatus) GetProviderStatus(name string) *ProviderStatus {
+	for i := range s.Providers {
+		if s.Providers[i].Name == name {
+			return &s.Providers[i]
+		}
+	}
+	return nil
 }
 
 type DomainNameList struct {
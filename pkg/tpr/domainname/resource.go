@@ -7,7 +7,6 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/dkoshkin/kube-external-dns/pkg/tpr"
 	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/client-go/pkg/api"
 	"k8s.io/client-go/rest"
 )
 
@@ -63,7 +62,7 @@ func (r *DomainNameResource) CreateOrUpdate(record *DomainName, namesapce string
 			logrus.Infof("%s: DomainName resource does not exists, will be creating it", record.Metadata.GetName())
 			var result DomainName
 			// TPR not found, create new record
-			if err := r.TPRClient.Post().Resource(r.Resource()).Namespace(api.NamespaceDefault).Body(record).Do().Into(&result); err != nil {
+			if err := r.TPRClient.Post().Resource(r.Resource()).Namespace(namesapce).Body(record).Do().Into(&result); err != nil {
 				return &result, fmt.Errorf("%s: error creating %s DomainName resource: %v", record.Metadata.GetName(), r.Resource(), err)
 			}
 			return &result, nil
@@ -74,8 +73,12 @@ func (r *DomainNameResource) CreateOrUpdate(record *DomainName, namesapce string
 	// update record
 	if foundRecord != nil {
 		logrus.Infof("%s: DomainName resource already exists, will be updating it", record.Metadata.Name)
-		logrus.Info("TOOD")
-		return foundRecord, nil
+		var result DomainName
+		record.Metadata.ResourceVersion = foundRecord.Metadata.ResourceVersion
+		if err := r.TPRClient.Put().Resource(r.Resource()).Namespace(namesapce).Name(record.Metadata.Name).Body(record).Do().Into(&result); err != nil {
+			return &result, fmt.Errorf("%s: error updating %s DomainName resource: %v", record.Metadata.GetName(), r.Resource(), err)
+		}
+		return &result, nil
 	}
 
 	return nil, fmt.Errorf("%s: error determining if DomainName resource exists", record.Metadata.Name)